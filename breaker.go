@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// longest the breaker stays open after repeated trips
+const maxBreakerCooldown = 10 * time.Minute
+
+// Circuit breaker failing open when mutate() keeps producing internal errors, so that a persistently
+// broken webhook does not block the cluster. It opens once threshold errors happen within window and
+// stays open for cooldown, doubled for each trip following the previous one without a quiet window.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	errors    []time.Time // internal errors within the window
+	openUntil time.Time
+	trips     int // consecutive trips, resets after a quiet window
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown}
+}
+
+// whether requests should be processed, false while the breaker is open
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.trips > 0 && time.Since(b.openUntil) > b.window {
+		glog.Infof("Circuit breaker recovered after %d trips", b.trips)
+		b.trips = 0
+	}
+}
+
+func (b *circuitBreaker) recordError() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	recent := b.errors[:0]
+	for _, t := range b.errors {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	b.errors = append(recent, now)
+	if len(b.errors) < b.threshold {
+		return
+	}
+
+	if now.Sub(b.openUntil) > b.window {
+		b.trips = 0
+	}
+	b.trips++
+	cooldown := b.cooldown
+	for i := 1; i < b.trips && cooldown < maxBreakerCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > maxBreakerCooldown {
+		cooldown = maxBreakerCooldown
+	}
+	b.openUntil = now.Add(cooldown)
+	b.errors = b.errors[:0]
+	glog.Errorf("Circuit breaker open: %d internal errors within %v, admitting requests unmutated for %v", b.threshold, b.window, cooldown)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute, time.Minute)
+	for i := 0; i < 2; i++ {
+		b.recordError()
+	}
+	if !b.allow() {
+		t.Fatal("breaker open below the threshold")
+	}
+	b.recordError()
+	if b.allow() {
+		t.Fatal("breaker closed after reaching the threshold")
+	}
+
+	// the cooldown has passed
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.allow() {
+		t.Error("breaker still open after the cooldown")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute, time.Minute)
+	b.errors = []time.Time{time.Now().Add(-2 * time.Minute)}
+	b.recordError()
+	if !b.allow() {
+		t.Error("error outside the window tripped the breaker")
+	}
+}
+
+func TestCircuitBreakerCooldown(t *testing.T) {
+	tests := []struct {
+		name         string
+		trips        int
+		quiet        bool // the previous trip ended more than a window ago
+		wantCooldown time.Duration
+	}{
+		{name: "first trip", wantCooldown: time.Minute},
+		{name: "second trip", trips: 1, wantCooldown: 2 * time.Minute},
+		{name: "third trip", trips: 2, wantCooldown: 4 * time.Minute},
+		{name: "capped", trips: 10, wantCooldown: maxBreakerCooldown},
+		{name: "after a quiet window", trips: 2, quiet: true, wantCooldown: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newCircuitBreaker(1, time.Minute, time.Minute)
+			b.trips = test.trips
+			if test.trips > 0 {
+				b.openUntil = time.Now().Add(-time.Second)
+				if test.quiet {
+					b.openUntil = time.Now().Add(-2 * time.Minute)
+				}
+			}
+			b.recordError()
+			cooldown := time.Until(b.openUntil)
+			if cooldown > test.wantCooldown || cooldown < test.wantCooldown-time.Second {
+				t.Errorf("open for %v, want %v", cooldown, test.wantCooldown)
+			}
+		})
+	}
+}
+
+func TestBreakerMutate(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "failurePolicy: Fail\n"))
+	whsvr.pipeline = []patchBuilder{{name: "broken", enabled: true, build: func(m *podMutation) ([]patchOperation, error) {
+		return nil, errors.New("cannot build")
+	}}}
+	whsvr.breaker = newCircuitBreaker(2, time.Minute, time.Minute)
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+
+	for i := 0; i < 2; i++ {
+		if resp := whsvr.breakerMutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true); resp.Allowed {
+			t.Fatalf("request %d admitted despite the failing mutation", i)
+		}
+	}
+	resp := whsvr.breakerMutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+	if !resp.Allowed || len(resp.Warnings) != 1 || resp.Patch != nil {
+		t.Errorf("open breaker answered %+v, want to admit unmutated with a warning", resp)
+	}
+}
+
+func TestBreakerMutateCancelled(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+	whsvr.responseDelay = time.Second
+	whsvr.breaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if resp := whsvr.breakerMutate(ctx, admissionReview(t, "Pod", pod.Namespace, pod), "", true); resp.Allowed {
+		t.Fatal("cancelled request admitted")
+	}
+	if !whsvr.breaker.allow() {
+		t.Error("breaker opened by a request the caller cancelled")
+	}
+}
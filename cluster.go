@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/net"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiversion "k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+const informerResync = 10 * time.Minute
+
+// time the informer caches have to sync at startup
+var cacheSyncTimeout = time.Minute
+
+// first Kubernetes version running init containers with restartPolicy Always as sidecars
+var nativeSidecarsVersion = utilversion.MustParseGeneric("1.28")
+
+// retries of live API calls failing with a transient error, the informer listers serve from their cache and need none
+var lookupBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: 50 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// run the API call, retrying it with backoff while it fails with a transient error
+func retryLookup(call func() error) error {
+	return retry.OnError(lookupBackoff, transientError, call)
+}
+
+func transientError(err error) bool {
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || net.IsConnectionRefused(err)
+}
+
+// in-cluster client, only created when a configured policy needs to read cluster state
+func newClientset() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// whether the API server is recent enough for native sidecars
+func nativeSidecarsSupported(client kubernetes.Interface) (bool, error) {
+	var info *apiversion.Info
+	err := retryLookup(func() (err error) {
+		info, err = client.Discovery().ServerVersion()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	serverVersion, err := utilversion.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return false, err
+	}
+	return serverVersion.AtLeast(nativeSidecarsVersion), nil
+}
+
+// cached lister of the namespaces
+func newNamespaceLister(client kubernetes.Interface, stopCh <-chan struct{}) (corelisters.NamespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(client, informerResync)
+	lister := factory.Core().V1().Namespaces().Lister()
+	factory.Start(stopCh)
+	if err := waitForCacheSync(factory); err != nil {
+		return nil, err
+	}
+	return lister, nil
+}
+
+// cached lister of the secrets with the given name in every namespace
+func newSecretLister(client kubernetes.Interface, name string, stopCh <-chan struct{}) (corelisters.SecretLister, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, informerResync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	lister := factory.Core().V1().Secrets().Lister()
+	factory.Start(stopCh)
+	if err := waitForCacheSync(factory); err != nil {
+		return nil, err
+	}
+	return lister, nil
+}
+
+// Wait for the started informers to list their objects. Gives up after cacheSyncTimeout, e.g. when RBAC
+// forbids the list or the API server can't be reached, rather than serving from an empty cache.
+func waitForCacheSync(factory informers.SharedInformerFactory) error {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(cacheSyncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	for informerType, synced := range factory.WaitForCacheSync(timeout) {
+		if !synced {
+			return fmt.Errorf("cache of %v not synced within %v", informerType, cacheSyncTimeout)
+		}
+	}
+	return nil
+}
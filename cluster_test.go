@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// shortens the lookup backoff for the test
+func fastLookupBackoff(t *testing.T) {
+	backoff := lookupBackoff
+	lookupBackoff = wait.Backoff{Steps: backoff.Steps, Duration: time.Millisecond, Factor: 1}
+	t.Cleanup(func() { lookupBackoff = backoff })
+}
+
+// fake clientset failing the first gets of the resource with a transient error, every get when failures is -1
+func flakyClientset(resource string, failures int, objects ...runtime.Object) (*fake.Clientset, *int) {
+	client := fake.NewSimpleClientset(objects...)
+	calls := 0
+	client.PrependReactor("get", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if failures < 0 || calls <= failures {
+			return true, nil, apierrors.NewServiceUnavailable("etcd leader changed")
+		}
+		return false, nil, nil
+	})
+	return client, &calls
+}
+
+func TestRetryLookup(t *testing.T) {
+	fastLookupBackoff(t)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "app-certs", Namespace: "default"}}
+	client, calls := flakyClientset("secrets", 2, secret)
+
+	whsvr := newTestServer(t, testConfig(t, "requiredSecret:\n  name: app-certs\n"))
+	// the informer has not seen the secret yet
+	whsvr.secretLister = corelisters.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	whsvr.client = client
+
+	message, err := whsvr.checkRequiredSecret("default")
+	if err != nil || message != "" {
+		t.Fatalf("checkRequiredSecret = %q, %v, want the secret found", message, err)
+	}
+	if *calls != 3 {
+		t.Errorf("%d gets, want 2 failed ones retried", *calls)
+	}
+}
+
+func TestLookupFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		resource     string
+		wantAllowed  bool
+		wantWarnings int
+	}{
+		{
+			name:     "secret lookup fails closed",
+			config:   "failurePolicy: Fail\nrequiredSecret:\n  name: app-certs\n",
+			resource: "secrets",
+		},
+		{
+			name:         "secret lookup fails open",
+			config:       "failurePolicy: Ignore\nrequiredSecret:\n  name: app-certs\n",
+			resource:     "secrets",
+			wantAllowed:  true,
+			wantWarnings: 1,
+		},
+		{
+			name:     "namespace lookup fails closed",
+			config:   "failurePolicy: Fail\nskipTerminatingNamespaces: true\n",
+			resource: "namespaces",
+		},
+		{
+			name:         "namespace lookup fails open",
+			config:       "failurePolicy: Ignore\nskipTerminatingNamespaces: true\n",
+			resource:     "namespaces",
+			wantAllowed:  true,
+			wantWarnings: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fastLookupBackoff(t)
+			client, calls := flakyClientset(test.resource, -1)
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"+test.config))
+			whsvr.secretLister = corelisters.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+			whsvr.namespaceLister = corelisters.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+			whsvr.client = client
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+
+			resp := whsvr.mutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+			if *calls != lookupBackoff.Steps {
+				t.Errorf("%d gets, want %d", *calls, lookupBackoff.Steps)
+			}
+			if resp.Allowed != test.wantAllowed {
+				t.Fatalf("allowed %v, want %v", resp.Allowed, test.wantAllowed)
+			}
+			if !resp.Allowed && resp.Result.Code != 500 {
+				t.Errorf("code %d, want 500", resp.Result.Code)
+			}
+			if resp.Patch != nil || len(resp.Warnings) != test.wantWarnings {
+				t.Errorf("patch %s, warnings %v, want no patch and %d warnings", resp.Patch, resp.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestCacheSyncFails(t *testing.T) {
+	timeout := cacheSyncTimeout
+	cacheSyncTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { cacheSyncTimeout = timeout })
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", nil)
+	})
+	if _, err := newSecretLister(client, "app-certs", stopCh); err == nil {
+		t.Error("secret lister returned without a synced cache")
+	}
+	if _, err := newNamespaceLister(client, stopCh); err == nil {
+		t.Error("namespace lister returned without a synced cache")
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Webhook policy configuration, loaded from the file given by -configFile
+type Config struct {
+	DefaultServiceAccount DefaultServiceAccountConfig `json:"defaultServiceAccount"`
+	IncludeNamespaces     []string                    `json:"includeNamespaces"`  // namespaces mutated when set, every namespace when empty
+	ExcludeContainers     []string                    `json:"excludeContainers"`  // container names never touched by mutations
+	MaxContainers         int                         `json:"maxContainers"`      // app + init containers allowed per pod, no limit when <= 0
+	MaxPatchOperations    int                         `json:"maxPatchOperations"` // operations allowed in one patch, no limit when <= 0
+	PriorityClassName     string                      `json:"priorityClassName"`  // set on pods without a priority class
+	ImagePullPolicy       corev1.PullPolicy           `json:"imagePullPolicy"`    // set on containers without an explicit pull policy, explicit ones equal to the image tag default included
+	PodLabels             map[string]string           `json:"podLabels"`          // added to pods, e.g. for platform network policies
+	RuntimeClass          RuntimeClassConfig          `json:"runtimeClass"`
+	DNS                   DNSConfig                   `json:"dns"`
+	ZoneAffinity          ZoneAffinityConfig          `json:"zoneAffinity"`
+	GoMaxProcs            GoMaxProcsConfig            `json:"goMaxProcs"`
+	DeniedCapabilities    []string                    `json:"deniedCapabilities"` // capabilities containers may not add, e.g. SYS_ADMIN
+	DeniedEnvVars         []string                    `json:"deniedEnvVars"`      // glob patterns of env var names containers may not set, e.g. AWS_SECRET*
+	AnnotationFormats     map[string]string           `json:"annotationFormats"`  // regexps pod annotation values must fully match, by annotation key
+	PreStop               PreStopConfig               `json:"preStop"`
+	StartupProbe          StartupProbeConfig          `json:"startupProbe"`
+	EnvFrom               EnvFromConfig               `json:"envFrom"`
+	ResourceDefaults      ResourceDefaultsConfig      `json:"resourceDefaults"`
+	RequiredSecret        RequiredSecretConfig        `json:"requiredSecret"`
+	AuditAnnotations      AuditAnnotationsConfig      `json:"auditAnnotations"`
+	HostNamespaces        HostNamespacesConfig        `json:"hostNamespaces"`
+	PrivilegedContainers  PrivilegedContainersConfig  `json:"privilegedContainers"`
+	LatestImageTag        LatestImageTagConfig        `json:"latestImageTag"`
+	Probes                ProbesConfig                `json:"probes"`
+	ImageSizeAttestation  ImageSizeAttestationConfig  `json:"imageSizeAttestation"`
+	ConfigMapVolume       ConfigMapVolumeConfig       `json:"configMapVolume"`
+	ServiceAccountToken   ServiceAccountTokenConfig   `json:"serviceAccountToken"`
+	MountConflictPolicy   string                      `json:"mountConflictPolicy"` // Warn or Skip injected mounts whose path is already in use
+	MountInitContainers   bool                        `json:"mountInitContainers"` // mount injected volumes into init containers too
+	MountContainers       string                      `json:"mountContainers"`     // regexp of the container names the injected volumes are mounted into, all when empty
+
+	// text/template rendering each pod rule denial from its .Rule, .Reason and .Namespace, e.g. to link to
+	// internal docs, the plain reason when empty
+	DenyMessageTemplate string `json:"denyMessageTemplate"`
+
+	// Enforce (deny) or Audit (admit with a warning) by pod rule name, overriding the rule's own action
+	RuleModes map[string]string `json:"ruleModes"`
+
+	// admit pods of namespaces being deleted unmutated
+	SkipTerminatingNamespaces bool `json:"skipTerminatingNamespaces"`
+
+	// pod mutations rolled out to a share of the requests only
+	Canary CanaryConfig `json:"canary"`
+
+	// named subsets of the enabled pod mutations, a request selecting one with the X-Webhook-Profile header
+	// only gets those, e.g. to test a staged rollout against the same endpoint
+	Profiles map[string][]string `json:"profiles"`
+
+	// certificates served to TLS clients asking for their server name, the others get --tlsCertFile
+	SNICertificates []SNICertificate `json:"sniCertificates"`
+
+	// pod mutations run first, in this order, the others keep their default order after them
+	MutationPipeline []MutationStep `json:"mutationPipeline"`
+
+	// operations mutated, requests of other operations are admitted unchanged
+	MutateOperations []admissionv1beta1.Operation `json:"mutateOperations"`
+
+	// merged into pods by topologyKey and whenUnsatisfiable
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints"`
+
+	// merged into pods, e.g. for injected containers needing dedicated nodes. Tolerations are pod-level,
+	// so they apply to every container of the pod.
+	Tolerations []corev1.Toleration `json:"tolerations"`
+
+	// set on pods without a termination grace period, disabled when unset
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds"`
+	// minimum lower termination grace periods, including the API server default of 30s, are raised to,
+	// disabled when unset
+	MinTerminationGracePeriodSeconds *int64 `json:"minTerminationGracePeriodSeconds"`
+
+	// pod securityContext.fsGroup set when unset, e.g. to make injected volumes writable by non-root containers
+	FSGroup *int64 `json:"fsGroup"`
+
+	// volumes injected into pods in addition to configMapVolume and serviceAccountToken
+	Volumes []VolumeConfig `json:"volumes"`
+	// hostPath volumes expose the node filesystem to every mutated pod, they are rejected unless enabled
+	AllowHostPathVolumes bool `json:"allowHostPathVolumes"`
+
+	// long-running containers appended to the pods' app containers, a pod already running a container
+	// of the same name keeps its own
+	Sidecars []corev1.Container `json:"sidecars"`
+	// inject the sidecars as init containers with restartPolicy Always, on clusters of Kubernetes 1.28 or
+	// later, older clusters get them as app containers
+	NativeSidecars bool `json:"nativeSidecars"`
+	// approved image references by name, pods select them for their sidecars with the sidecar-images
+	// annotation rather than naming an arbitrary image
+	SidecarImages map[string]string `json:"sidecarImages"`
+
+	// JSON patches applied to objects of any kind, including kinds the webhook does not decode
+	GenericPatches []GenericPatchConfig `json:"genericPatches"`
+
+	// Ignore applies the patches of the mutations which succeeded, Fail denies the request
+	FailurePolicy admissionregistrationv1beta1.FailurePolicyType `json:"failurePolicy"`
+
+	checksum          string                    // sha256 of the loaded file
+	annotationFormats map[string]*regexp.Regexp // compiled AnnotationFormats
+	mountContainers   *regexp.Regexp            // compiled MountContainers, nil when unset
+	denyMessage       *template.Template        // parsed DenyMessageTemplate, nil when unset
+}
+
+// Namespaces and service accounts a policy rule does not apply to
+type Exemptions struct {
+	Namespaces      []string `json:"namespaces"`
+	ServiceAccounts []string `json:"serviceAccounts"` // namespace/name
+}
+
+// Denies Pods running as the "default" service account
+type DefaultServiceAccountConfig struct {
+	Enabled           bool       `json:"enabled"`
+	Namespaces        []string   `json:"namespaces"`        // enforced namespaces, every namespace when both are empty
+	NamespaceSelector string     `json:"namespaceSelector"` // labels of further enforced namespaces, e.g. environment=production
+	Exemptions        Exemptions `json:"exemptions"`
+
+	namespaceSelector labels.Selector // parsed NamespaceSelector, nil when unset
+}
+
+const (
+	defaultMaxContainers      = 20
+	defaultMaxPatchOperations = 1000
+
+	mountConflictWarn = "Warn"
+	mountConflictSkip = "Skip"
+
+	ruleActionDeny = "Deny"
+	ruleActionWarn = "Warn"
+
+	ruleModeEnforce = "Enforce"
+	ruleModeAudit   = "Audit"
+
+	// bounds the API server enforces on projected service account token expirations
+	minTokenExpirationSeconds = 600
+	maxTokenExpirationSeconds = 1 << 32
+)
+
+// Denies Pods sharing the node's network, PID or IPC namespace
+type HostNamespacesConfig struct {
+	DenyHostNetwork bool       `json:"denyHostNetwork"`
+	DenyHostPID     bool       `json:"denyHostPID"`
+	DenyHostIPC     bool       `json:"denyHostIPC"`
+	Exemptions      Exemptions `json:"exemptions"`
+}
+
+// Denies Pods with privileged app or init containers
+type PrivilegedContainersConfig struct {
+	Enabled    bool       `json:"enabled"`
+	Exemptions Exemptions `json:"exemptions"`
+}
+
+// Denies (or warns about) containers using the latest tag or no tag, images pinned by digest always pass
+type LatestImageTagConfig struct {
+	Enabled    bool       `json:"enabled"`
+	Action     string     `json:"action"` // Deny or Warn
+	Exemptions Exemptions `json:"exemptions"`
+	PullAlways bool       `json:"pullAlways"` // mutate imagePullPolicy to Always on such containers, independent of enabled
+}
+
+// Denies (or warns about) app containers without any liveness or readiness probe, init containers are not checked
+type ProbesConfig struct {
+	Enabled          bool       `json:"enabled"`
+	Action           string     `json:"action"` // Deny or Warn
+	Exemptions       Exemptions `json:"exemptions"`
+	ExemptContainers []string   `json:"exemptContainers"` // container names not checked, e.g. istio-proxy
+}
+
+// Denies Pods lacking the annotation, set by a CI pipeline, attesting that their images comply with the size policy.
+// The webhook cannot measure image sizes itself.
+type ImageSizeAttestationConfig struct {
+	AnnotationKey string     `json:"annotationKey"` // must be "true" on the pod, disabled when empty
+	Exemptions    Exemptions `json:"exemptions"`
+}
+
+// Read-only ConfigMap volume injected into pods and mounted into their containers
+type ConfigMapVolumeConfig struct {
+	Name          string `json:"name"` // volume name, disabled when empty
+	ConfigMapName string `json:"configMapName"`
+	MountPath     string `json:"mountPath"`
+}
+
+// Volume injected into pods and mounted into every mutable container
+type VolumeConfig struct {
+	corev1.Volume
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath"` // path within the volume mounted instead of its root
+	ReadOnly  bool   `json:"readOnly"`
+}
+
+// JSON patch operations applied as is to objects of the listed kinds
+type GenericPatchConfig struct {
+	Kinds []string         `json:"kinds"`
+	Patch []patchOperation `json:"patch"`
+}
+
+// Projected service account token volume with a dedicated audience, mounted read-only into the containers
+type ServiceAccountTokenConfig struct {
+	VolumeName        string `json:"volumeName"` // disabled when empty
+	Audience          string `json:"audience"`
+	ExpirationSeconds int64  `json:"expirationSeconds"` // at least 600, the API server default of one hour when 0
+	Path              string `json:"path"`              // token file name inside the volume
+	MountPath         string `json:"mountPath"`
+}
+
+// Runtime class, e.g. gVisor or Kata, set on pods without one
+type RuntimeClassConfig struct {
+	Name       string   `json:"name"`       // disabled when empty
+	Namespaces []string `json:"namespaces"` // targeted namespaces, every namespace when empty
+}
+
+// Zones pods may request through the zone annotation, pinning them to the nodes labeled with the zone
+type ZoneAffinityConfig struct {
+	Zones       []string `json:"zones"`       // disabled when empty
+	TopologyKey string   `json:"topologyKey"` // node label holding the zone, topology.kubernetes.io/zone by default
+}
+
+// DNS policy and config, e.g. custom nameservers or search domains, set on pods which do not set them
+type DNSConfig struct {
+	Policy corev1.DNSPolicy     `json:"policy"` // disabled when empty
+	Config *corev1.PodDNSConfig `json:"config"` // disabled when unset
+}
+
+// Lifecycle preStop hook set on containers, e.g. to let them drain
+type PreStopConfig struct {
+	Containers []string        `json:"containers"` // targeted container names, every container when empty
+	Handler    *corev1.Handler `json:"handler"`    // exec or httpGet, disabled when unset
+}
+
+// Startup probe injected into app containers without one, giving slow-starting apps time before liveness checks
+type StartupProbeConfig struct {
+	Containers []string      `json:"containers"` // targeted container names, every container when empty
+	Probe      *corev1.Probe `json:"probe"`      // disabled when unset
+}
+
+// Audit annotations recording admission decisions in the API server audit log
+type AuditAnnotationsConfig struct {
+	Enabled bool              `json:"enabled"`
+	Extra   map[string]string `json:"extra"` // static annotations added to every decision
+}
+
+// ConfigMap and Secret envFrom sources added to containers
+type EnvFromConfig struct {
+	Containers []string               `json:"containers"` // targeted container names, every container when empty
+	Sources    []corev1.EnvFromSource `json:"sources"`
+}
+
+// GOMAXPROCS set from the CPU limit of the targeted containers limited to whole cores, so that the Go
+// runtime does not run more threads than the container may use
+type GoMaxProcsConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Containers []string `json:"containers"` // targeted container names, every container when empty
+}
+
+// Resource requests and limits set on containers which do not declare them, e.g. ephemeral-storage
+type ResourceDefaultsConfig struct {
+	Containers []string            `json:"containers"` // targeted container names, every container when empty
+	Requests   corev1.ResourceList `json:"requests"`
+	Limits     corev1.ResourceList `json:"limits"`
+}
+
+// Gradual rollout of new pod mutations, applied to the requests whose UID hashes below percent
+type CanaryConfig struct {
+	Mutations []string `json:"mutations"` // pod mutation names, e.g. env-from
+	Percent   int      `json:"percent"`   // 0 to 100
+}
+
+// Certificate and key files served to clients requesting serverName through SNI
+type SNICertificate struct {
+	ServerName string `json:"serverName"`
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+}
+
+// Pod mutation run after the mutations named in after, in addition to its built-in dependencies
+type MutationStep struct {
+	Name  string   `json:"name"`
+	After []string `json:"after"`
+}
+
+// Secret which must exist in the pod namespace before pods are mutated
+type RequiredSecretConfig struct {
+	Name   string `json:"name"`   // disabled when empty
+	Action string `json:"action"` // Deny the pod, or Warn and admit it without mutation
+}
+
+func loadConfig(configFile string) (*Config, error) {
+	cfg := Config{
+		MaxContainers:       defaultMaxContainers,
+		MaxPatchOperations:  defaultMaxPatchOperations,
+		MutateOperations:    []admissionv1beta1.Operation{admissionv1beta1.Create},
+		FailurePolicy:       admissionregistrationv1beta1.Fail,
+		MountConflictPolicy: mountConflictSkip,
+		LatestImageTag:      LatestImageTagConfig{Action: ruleActionDeny},
+		Probes:              ProbesConfig{Action: ruleActionDeny},
+		RequiredSecret:      RequiredSecretConfig{Action: ruleActionWarn},
+		ZoneAffinity:        ZoneAffinityConfig{TopologyKey: corev1.LabelZoneFailureDomainStable},
+	}
+	if configFile == "" {
+		return &cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.checksum = fmt.Sprintf("%x", sha256.Sum256(data))
+	glog.Infof("New configuration: sha256sum %s", cfg.checksum)
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.FailurePolicy != admissionregistrationv1beta1.Ignore && cfg.FailurePolicy != admissionregistrationv1beta1.Fail {
+		return fmt.Errorf("failurePolicy must be %s or %s", admissionregistrationv1beta1.Ignore, admissionregistrationv1beta1.Fail)
+	}
+	if selector := cfg.DefaultServiceAccount.NamespaceSelector; selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return fmt.Errorf("defaultServiceAccount.namespaceSelector: %v", err)
+		}
+		cfg.DefaultServiceAccount.namespaceSelector = parsed
+	}
+	if handler := cfg.PreStop.Handler; handler != nil && handler.Exec == nil && handler.HTTPGet == nil {
+		return errors.New("preStop.handler must define exec or httpGet")
+	}
+	if probe := cfg.StartupProbe.Probe; probe != nil && probe.Exec == nil && probe.HTTPGet == nil && probe.TCPSocket == nil {
+		return errors.New("startupProbe.probe must define exec, httpGet or tcpSocket")
+	}
+	for _, source := range cfg.EnvFrom.Sources {
+		if (source.ConfigMapRef == nil) == (source.SecretRef == nil) {
+			return errors.New("envFrom.sources must each set exactly one of configMapRef or secretRef")
+		}
+	}
+	for name, request := range cfg.ResourceDefaults.Requests {
+		if limit, ok := cfg.ResourceDefaults.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("resourceDefaults: %s request %s exceeds the limit %s", name, request.String(), limit.String())
+		}
+	}
+	if len(cfg.ZoneAffinity.Zones) > 0 && cfg.ZoneAffinity.TopologyKey == "" {
+		return errors.New("zoneAffinity.topologyKey must be set")
+	}
+	switch cfg.ImagePullPolicy {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return fmt.Errorf("imagePullPolicy must be %s, %s or %s", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+	}
+	if cfg.DenyMessageTemplate != "" {
+		tmpl, err := template.New("denyMessage").Option("missingkey=error").Parse(cfg.DenyMessageTemplate)
+		if err != nil {
+			return fmt.Errorf("denyMessageTemplate: %v", err)
+		}
+		cfg.denyMessage = tmpl
+	}
+	if cfg.MountContainers != "" {
+		format, err := regexp.Compile("^(?:" + cfg.MountContainers + ")$")
+		if err != nil {
+			return fmt.Errorf("mountContainers: invalid pattern: %v", err)
+		}
+		cfg.mountContainers = format
+	}
+	cfg.annotationFormats = make(map[string]*regexp.Regexp, len(cfg.AnnotationFormats))
+	for key, pattern := range cfg.AnnotationFormats {
+		format, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("annotationFormats: invalid pattern for %s: %v", key, err)
+		}
+		cfg.annotationFormats[key] = format
+	}
+	// the API server rejects responses carrying audit annotation keys which are not qualified names
+	if cfg.AuditAnnotations.Enabled {
+		for key := range cfg.AuditAnnotations.Extra {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("auditAnnotations.extra: invalid key %q: %s", key, strings.Join(errs, "; "))
+			}
+		}
+	}
+	for _, pattern := range cfg.DeniedEnvVars {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("deniedEnvVars: invalid pattern %q", pattern)
+		}
+	}
+	if seconds := cfg.TerminationGracePeriodSeconds; seconds != nil && *seconds < 0 {
+		return errors.New("terminationGracePeriodSeconds must not be negative")
+	}
+	if seconds := cfg.MinTerminationGracePeriodSeconds; seconds != nil && *seconds < 0 {
+		return errors.New("minTerminationGracePeriodSeconds must not be negative")
+	}
+	switch cfg.DNS.Policy {
+	case "", corev1.DNSClusterFirst, corev1.DNSClusterFirstWithHostNet, corev1.DNSDefault:
+	case corev1.DNSNone:
+		if cfg.DNS.Config == nil || len(cfg.DNS.Config.Nameservers) == 0 {
+			return errors.New("dns.config.nameservers must be set with dns.policy None")
+		}
+	default:
+		return fmt.Errorf("dns: unsupported policy %q", cfg.DNS.Policy)
+	}
+	for _, operation := range cfg.MutateOperations {
+		if operation != admissionv1beta1.Create && operation != admissionv1beta1.Update {
+			return fmt.Errorf("mutateOperations: unsupported operation %q, expect %s or %s", operation, admissionv1beta1.Create, admissionv1beta1.Update)
+		}
+	}
+	if cfg.Canary.Percent < 0 || cfg.Canary.Percent > 100 {
+		return errors.New("canary.percent must be between 0 and 100")
+	}
+	for name, mode := range cfg.RuleModes {
+		if mode != ruleModeEnforce && mode != ruleModeAudit {
+			return fmt.Errorf("ruleModes: mode of %s must be %s or %s", name, ruleModeEnforce, ruleModeAudit)
+		}
+	}
+	if cfg.MountConflictPolicy != mountConflictWarn && cfg.MountConflictPolicy != mountConflictSkip {
+		return fmt.Errorf("mountConflictPolicy must be %s or %s", mountConflictWarn, mountConflictSkip)
+	}
+	if cfg.LatestImageTag.Action != ruleActionDeny && cfg.LatestImageTag.Action != ruleActionWarn {
+		return fmt.Errorf("latestImageTag.action must be %s or %s", ruleActionDeny, ruleActionWarn)
+	}
+	if cfg.Probes.Action != ruleActionDeny && cfg.Probes.Action != ruleActionWarn {
+		return fmt.Errorf("probes.action must be %s or %s", ruleActionDeny, ruleActionWarn)
+	}
+	if cfg.RequiredSecret.Action != ruleActionDeny && cfg.RequiredSecret.Action != ruleActionWarn {
+		return fmt.Errorf("requiredSecret.action must be %s or %s", ruleActionDeny, ruleActionWarn)
+	}
+	if token := cfg.ServiceAccountToken; token.VolumeName != "" {
+		if token.Path == "" {
+			return errors.New("serviceAccountToken.path must be set")
+		}
+		if !path.IsAbs(token.MountPath) {
+			return errors.New("serviceAccountToken.mountPath must be an absolute path")
+		}
+		// 0 leaves the expiration to the API server default of one hour
+		if seconds := token.ExpirationSeconds; seconds != 0 && (seconds < minTokenExpirationSeconds || seconds > maxTokenExpirationSeconds) {
+			return fmt.Errorf("serviceAccountToken.expirationSeconds must be between %d and %d", minTokenExpirationSeconds, int64(maxTokenExpirationSeconds))
+		}
+	}
+	for _, volume := range cfg.Volumes {
+		if volume.Name == "" {
+			return errors.New("volumes: name must be set")
+		}
+		if !path.IsAbs(volume.MountPath) {
+			return fmt.Errorf("volumes: mountPath of %s must be an absolute path", volume.Name)
+		}
+		if path.IsAbs(volume.SubPath) || strings.HasPrefix(path.Clean(volume.SubPath), "..") {
+			return fmt.Errorf("volumes: subPath of %s must be a relative path within the volume", volume.Name)
+		}
+		if volume.HostPath != nil && !cfg.AllowHostPathVolumes {
+			return fmt.Errorf("volumes: hostPath volume %s requires allowHostPathVolumes", volume.Name)
+		}
+	}
+	if err := cfg.validateInjectedMounts(); err != nil {
+		return err
+	}
+	serverNames := map[string]bool{}
+	for _, sni := range cfg.SNICertificates {
+		if sni.ServerName == "" || sni.CertFile == "" || sni.KeyFile == "" {
+			return errors.New("sniCertificates: serverName, certFile and keyFile must be set")
+		}
+		if serverNames[strings.ToLower(sni.ServerName)] {
+			return fmt.Errorf("sniCertificates: duplicate server name %s", sni.ServerName)
+		}
+		serverNames[strings.ToLower(sni.ServerName)] = true
+	}
+	sidecars := map[string]bool{}
+	for _, sidecar := range cfg.Sidecars {
+		if sidecar.Name == "" || sidecar.Image == "" {
+			return errors.New("sidecars: name and image must be set")
+		}
+		if sidecars[sidecar.Name] {
+			return fmt.Errorf("sidecars: duplicate container %s", sidecar.Name)
+		}
+		sidecars[sidecar.Name] = true
+	}
+	for name, image := range cfg.SidecarImages {
+		if image == "" {
+			return fmt.Errorf("sidecarImages: image of %s must be set", name)
+		}
+	}
+	for _, generic := range cfg.GenericPatches {
+		for _, operation := range generic.Patch {
+			switch operation.Op {
+			case "add", "remove", "replace":
+			default:
+				return fmt.Errorf("genericPatches: unsupported operation %q", operation.Op)
+			}
+			if !strings.HasPrefix(operation.Path, "/") {
+				return fmt.Errorf("genericPatches: path %q must start with /", operation.Path)
+			}
+			if operation.Op != "remove" && operation.Value == nil {
+				return fmt.Errorf("genericPatches: %s %s must have a value", operation.Op, operation.Path)
+			}
+		}
+	}
+	if volume := cfg.ConfigMapVolume; volume.Name != "" {
+		if volume.ConfigMapName == "" {
+			return errors.New("configMapVolume.configMapName must be set")
+		}
+		if !path.IsAbs(volume.MountPath) {
+			return errors.New("configMapVolume.mountPath must be an absolute path")
+		}
+	}
+	return nil
+}
+
+// the injected volumes would make pods invalid when two of them share a name or a mount path
+func (cfg *Config) validateInjectedMounts() error {
+	type injected struct{ name, mountPath string }
+	var mounts []injected
+	if cfg.ConfigMapVolume.Name != "" {
+		mounts = append(mounts, injected{cfg.ConfigMapVolume.Name, cfg.ConfigMapVolume.MountPath})
+	}
+	if cfg.ServiceAccountToken.VolumeName != "" {
+		mounts = append(mounts, injected{cfg.ServiceAccountToken.VolumeName, cfg.ServiceAccountToken.MountPath})
+	}
+	for _, volume := range cfg.Volumes {
+		mounts = append(mounts, injected{volume.Name, volume.MountPath})
+	}
+
+	names := map[string]bool{}
+	mountPaths := map[string]string{}
+	for _, mount := range mounts {
+		if names[mount.name] {
+			return fmt.Errorf("volume %s is injected more than once", mount.name)
+		}
+		names[mount.name] = true
+		mountPath := path.Clean(mount.mountPath)
+		if other, ok := mountPaths[mountPath]; ok {
+			return fmt.Errorf("volumes %s and %s are both mounted at %s", other, mount.name, mountPath)
+		}
+		mountPaths[mountPath] = mount.name
+	}
+	return nil
+}
+
+// whether requests of the operation are mutated
+func (cfg *Config) mutatedOperation(operation admissionv1beta1.Operation) bool {
+	for _, mutated := range cfg.MutateOperations {
+		if mutated == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// whether objects in the namespace are mutated, the ignored system namespaces are skipped regardless
+func (cfg *Config) mutatedNamespace(namespace string) bool {
+	return len(cfg.IncludeNamespaces) == 0 || contains(cfg.IncludeNamespaces, namespace)
+}
+
+// generic patch operations configured for objects of the kind
+func (cfg *Config) genericPatches(kind string) (patch []patchOperation) {
+	for _, generic := range cfg.GenericPatches {
+		if contains(generic.Kinds, kind) {
+			patch = append(patch, generic.Patch...)
+		}
+	}
+	return patch
+}
+
+func (e Exemptions) exempt(namespace, serviceAccount string) bool {
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return contains(e.Namespaces, namespace) || contains(e.ServiceAccounts, namespace+"/"+serviceAccount)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
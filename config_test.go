@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg := testConfig(t, "maxContainers: 5\n")
+	if cfg.MaxContainers != 5 {
+		t.Errorf("maxContainers %d, want 5 from the file", cfg.MaxContainers)
+	}
+	if cfg.MaxPatchOperations != defaultMaxPatchOperations || cfg.FailurePolicy != admissionregistrationv1beta1.Fail ||
+		cfg.MountConflictPolicy != mountConflictSkip || cfg.LatestImageTag.Action != ruleActionDeny ||
+		cfg.ZoneAffinity.TopologyKey != corev1.LabelZoneFailureDomainStable {
+		t.Errorf("defaults missing from %+v", cfg)
+	}
+	if cfg.checksum == "" {
+		t.Error("checksum of the file missing")
+	}
+
+	if _, err := loadConfig("no-such-file.yaml"); err == nil {
+		t.Error("missing file accepted")
+	}
+	if _, err := loadConfig(""); err != nil {
+		t.Errorf("defaults rejected without a file: %v", err)
+	}
+}
+
+// the configuration shipped in the deployment configmap is valid
+func TestShippedConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("deployment/configmap.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configMap corev1.ConfigMap
+	if err := yaml.Unmarshal(data, &configMap); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, configMap.Data["config.yaml"])
+	newTestServer(t, cfg)
+	if cfg.DefaultServiceAccount.Enabled {
+		t.Error("defaultServiceAccount enabled, denying the sleep examples")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "failure policy", config: "failurePolicy: Retry\n", wantErr: "failurePolicy must be"},
+		{name: "namespace selector", config: "defaultServiceAccount:\n  namespaceSelector: \"a b\"\n", wantErr: "namespaceSelector"},
+		{name: "pre-stop handler", config: "preStop:\n  handler: {}\n", wantErr: "preStop.handler"},
+		{name: "startup probe", config: "startupProbe:\n  probe: {}\n", wantErr: "startupProbe.probe"},
+		{
+			name:    "env from source",
+			config:  "envFrom:\n  sources:\n    - configMapRef: {name: a}\n      secretRef: {name: b}\n",
+			wantErr: "exactly one of configMapRef or secretRef",
+		},
+		{
+			name:    "resource request over the limit",
+			config:  "resourceDefaults:\n  requests: {memory: 2Gi}\n  limits: {memory: 1Gi}\n",
+			wantErr: "memory request 2Gi exceeds the limit 1Gi",
+		},
+		{name: "zone topology key", config: "zoneAffinity:\n  zones: [\"eu-west-1a\"]\n  topologyKey: \"\"\n", wantErr: "zoneAffinity.topologyKey"},
+		{name: "image pull policy", config: "imagePullPolicy: Sometimes\n", wantErr: "imagePullPolicy must be"},
+		{name: "deny message template", config: "denyMessageTemplate: \"{{.Rule\"\n", wantErr: "denyMessageTemplate"},
+		{name: "mount containers", config: "mountContainers: \"app-(\"\n", wantErr: "mountContainers"},
+		{name: "annotation format", config: "annotationFormats:\n  example.com/team: \"[\"\n", wantErr: "annotationFormats"},
+		{name: "audit annotation key", config: "auditAnnotations:\n  enabled: true\n  extra:\n    \"cost center\": a\n", wantErr: "auditAnnotations.extra"},
+		{name: "audit annotation key disabled", config: "auditAnnotations:\n  enabled: false\n  extra:\n    \"cost center\": a\n"},
+		{name: "denied env var pattern", config: "deniedEnvVars: [\"AWS_[\"]\n", wantErr: "deniedEnvVars"},
+		{name: "termination grace period", config: "terminationGracePeriodSeconds: -1\n", wantErr: "must not be negative"},
+		{name: "minimum termination grace period", config: "minTerminationGracePeriodSeconds: -1\n", wantErr: "must not be negative"},
+		{name: "dns without nameservers", config: "dns:\n  policy: None\n", wantErr: "dns.config.nameservers"},
+		{name: "dns policy", config: "dns:\n  policy: Cluster\n", wantErr: "unsupported policy"},
+		{name: "mutate operation", config: "mutateOperations: [\"DELETE\"]\n", wantErr: "mutateOperations"},
+		{name: "canary percent", config: "canary:\n  percent: 101\n", wantErr: "canary.percent"},
+		{name: "rule mode", config: "ruleModes:\n  probes: Ignore\n", wantErr: "ruleModes"},
+		{name: "mount conflict policy", config: "mountConflictPolicy: Replace\n", wantErr: "mountConflictPolicy"},
+		{name: "latest image tag action", config: "latestImageTag:\n  action: Block\n", wantErr: "latestImageTag.action"},
+		{name: "probes action", config: "probes:\n  action: Block\n", wantErr: "probes.action"},
+		{name: "required secret action", config: "requiredSecret:\n  action: Block\n", wantErr: "requiredSecret.action"},
+		{
+			name:    "token expiration",
+			config:  "serviceAccountToken:\n  volumeName: token\n  path: token\n  mountPath: /var/run/token\n  expirationSeconds: 60\n",
+			wantErr: "serviceAccountToken.expirationSeconds",
+		},
+		{name: "volume name", config: "volumes:\n  - emptyDir: {}\n    mountPath: /cache\n", wantErr: "volumes: name must be set"},
+		{name: "volume mount path", config: "volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: cache\n", wantErr: "absolute path"},
+		{
+			name:    "volume sub path",
+			config:  "volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /cache\n    subPath: ../etc\n",
+			wantErr: "subPath of cache",
+		},
+		{
+			name:    "duplicate mount path",
+			config:  "volumes:\n  - name: a\n    emptyDir: {}\n    mountPath: /cache\n  - name: b\n    emptyDir: {}\n    mountPath: /cache\n",
+			wantErr: "both mounted at /cache",
+		},
+		{name: "sni certificate", config: "sniCertificates:\n  - serverName: example.com\n", wantErr: "sniCertificates"},
+		{name: "sidecar image", config: "sidecars:\n  - name: log-shipper\n", wantErr: "sidecars: name and image must be set"},
+		{
+			name:    "duplicate sidecar",
+			config:  "sidecars:\n  - {name: log-shipper, image: a}\n  - {name: log-shipper, image: b}\n",
+			wantErr: "duplicate container log-shipper",
+		},
+		{name: "sidecar image name", config: "sidecarImages:\n  fluent-bit: \"\"\n", wantErr: "sidecarImages"},
+		{
+			name:    "generic patch operation",
+			config:  "genericPatches:\n  - kinds: [\"ConfigMap\"]\n    patch:\n      - {op: move, path: /data}\n",
+			wantErr: "unsupported operation",
+		},
+		{
+			name:    "generic patch path",
+			config:  "genericPatches:\n  - kinds: [\"ConfigMap\"]\n    patch:\n      - {op: add, path: data, value: {}}\n",
+			wantErr: "must start with /",
+		},
+		{
+			name:    "generic patch value",
+			config:  "genericPatches:\n  - kinds: [\"ConfigMap\"]\n    patch:\n      - {op: replace, path: /data/level}\n",
+			wantErr: "must have a value",
+		},
+		{
+			name:    "host path volume",
+			config:  "volumes:\n  - name: vault\n    hostPath:\n      path: /var/run/vault\n    mountPath: /vault\n",
+			wantErr: "requires allowHostPathVolumes",
+		},
+		{
+			name:   "allowed host path volume",
+			config: "allowHostPathVolumes: true\nvolumes:\n  - name: vault\n    hostPath:\n      path: /var/run/vault\n    mountPath: /vault\n",
+		},
+		{name: "configmap volume", config: "configMapVolume:\n  name: app-config\n  mountPath: /etc/app\n", wantErr: "configMapVolume.configMapName"},
+		{name: "valid", config: "maxContainers: 5\nimagePullPolicy: IfNotPresent\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig(configFile(t, test.config))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("valid configuration rejected: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
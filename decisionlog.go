@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// records waiting to be written, further decisions are dropped while the buffer is full
+const decisionLogBuffer = 1024
+
+// admission decision appended to the decision log as a JSON line
+type decisionRecord struct {
+	Time      time.Time `json:"time"`
+	UID       types.UID `json:"uid"`
+	Path      string    `json:"path"` // /mutate or /validate
+	Namespace string    `json:"namespace"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Operation string    `json:"operation"`
+	Allowed   bool      `json:"allowed"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// Best-effort local audit trail of admission decisions, independent of the cluster audit log.
+// Records are written by a background goroutine so that admission never waits on the disk,
+// the file is rotated to <path>.1 once it would grow past maxBytes.
+type decisionLog struct {
+	path     string
+	maxBytes int64
+	records  chan decisionRecord
+	done     chan struct{}
+
+	file *os.File
+	size int64
+}
+
+func newDecisionRecord(path string, req *v1beta1.AdmissionRequest, resp *v1beta1.AdmissionResponse) decisionRecord {
+	record := decisionRecord{
+		Time:      time.Now().UTC(),
+		UID:       req.UID,
+		Path:      path,
+		Namespace: req.Namespace,
+		Kind:      req.Kind.Kind,
+		Name:      req.Name,
+		Operation: string(req.Operation),
+		Allowed:   resp.Allowed,
+	}
+	if resp.Result != nil {
+		record.Message = resp.Result.Message
+	}
+	return record
+}
+
+func newDecisionLog(path string, maxBytes int64) (*decisionLog, error) {
+	l := &decisionLog{
+		path:     path,
+		maxBytes: maxBytes,
+		records:  make(chan decisionRecord, decisionLogBuffer),
+		done:     make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *decisionLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// queue the record without blocking, it is dropped when the writer falls behind
+func (l *decisionLog) record(record decisionRecord) {
+	select {
+	case l.records <- record:
+	default:
+		glog.Warningf("Decision log buffer full, dropping the decision on %v", record.UID)
+	}
+}
+
+// flush the queued records and close the file, record must not be called afterwards
+func (l *decisionLog) close() {
+	close(l.records)
+	<-l.done
+}
+
+func (l *decisionLog) run() {
+	defer close(l.done)
+	for record := range l.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			glog.Errorf("Can't encode decision record: %v", err)
+			continue
+		}
+		line = append(line, '\n')
+		if err := l.write(line); err != nil {
+			glog.Errorf("Can't write decision log: %v", err)
+		}
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+func (l *decisionLog) write(line []byte) error {
+	if l.file == nil {
+		// a previous rotation failed to reopen the file
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *decisionLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// decision records of the JSON lines file
+func readDecisions(t *testing.T, path string) []decisionRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []decisionRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record decisionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid line %s: %v", scanner.Bytes(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDecisionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisionlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "decisions.json")
+
+	req := &v1beta1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Name:      "app",
+		Operation: v1beta1.Create,
+	}
+	denied := &v1beta1.AdmissionResponse{Result: &metav1.Status{Message: "pods may not set hostNetwork"}}
+	record := newDecisionRecord("/validate", req, denied)
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room for two records before rotating
+	l, err := newDecisionLog(path, int64(2*(len(line)+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []types.UID{"uid-1", "uid-2", "uid-3"} {
+		record.UID = uid
+		l.record(record)
+	}
+	l.close()
+
+	rotated := readDecisions(t, path+".1")
+	current := readDecisions(t, path)
+	if len(rotated) != 2 || len(current) != 1 || current[0].UID != "uid-3" {
+		t.Fatalf("rotated %v and current %v, want two records rotated out before the third", rotated, current)
+	}
+	if got := rotated[0]; got.Path != "/validate" || got.Kind != "Pod" || got.Name != "app" || got.Operation != "CREATE" ||
+		got.Allowed || got.Message != "pods may not set hostNetwork" {
+		t.Errorf("record %+v does not match the decision", got)
+	}
+}
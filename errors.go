@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admission failure reported to the API server in the response status
+type admissionError struct {
+	code    int32
+	reason  metav1.StatusReason
+	message string
+}
+
+func (e *admissionError) Error() string {
+	return e.message
+}
+
+func (e *admissionError) status() *metav1.Status {
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    e.code,
+		Reason:  e.reason,
+		Message: e.message,
+	}
+}
+
+func (e *admissionError) toAdmissionResponse() *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result:  e.status(),
+	}
+}
+
+// the admission request or the object under review could not be decoded
+func badRequestError(err error) *admissionError {
+	return &admissionError{code: http.StatusBadRequest, reason: metav1.StatusReasonBadRequest, message: err.Error()}
+}
+
+// the object violates a validation rule
+func deniedError(message string) *admissionError {
+	return &admissionError{code: http.StatusForbidden, reason: metav1.StatusReasonForbidden, message: message}
+}
+
+// the webhook failed to process a valid request
+func internalError(err error) *admissionError {
+	return &admissionError{code: http.StatusInternalServerError, reason: metav1.StatusReasonInternalError, message: err.Error()}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAdmissionErrorResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        *admissionError
+		wantCode   int32
+		wantReason metav1.StatusReason
+	}{
+		{name: "bad request", err: badRequestError(errors.New("invalid JSON")), wantCode: http.StatusBadRequest, wantReason: metav1.StatusReasonBadRequest},
+		{name: "denied", err: deniedError("required labels are not set"), wantCode: http.StatusForbidden, wantReason: metav1.StatusReasonForbidden},
+		{name: "internal", err: internalError(errors.New("mutation failed")), wantCode: http.StatusInternalServerError, wantReason: metav1.StatusReasonInternalError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := test.err.toAdmissionResponse()
+			if resp.Allowed {
+				t.Error("failure allowed")
+			}
+			status := resp.Result
+			if status.Code != test.wantCode || status.Reason != test.wantReason || status.Status != metav1.StatusFailure {
+				t.Errorf("status %d %s %s, want %d %s %s", status.Code, status.Reason, status.Status, test.wantCode, test.wantReason, metav1.StatusFailure)
+			}
+			if status.Message != test.err.Error() {
+				t.Errorf("message %q, want %q", status.Message, test.err.Error())
+			}
+		})
+	}
+}
+
+func TestAdmissionErrorStatus(t *testing.T) {
+	failing := patchBuilder{name: "broken", enabled: true, build: func(m *podMutation) ([]patchOperation, error) {
+		return nil, errors.New("cannot build")
+	}}
+	tests := []struct {
+		name       string
+		path       string
+		review     func(*testing.T) *v1beta1.AdmissionReview
+		wantCode   int32
+		wantReason metav1.StatusReason
+	}{
+		{
+			name: "undecodable pod",
+			path: "/mutate",
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				review := admissionReview(t, "Pod", "default", testPod())
+				review.Request.Object.Raw = []byte("{")
+				return review
+			},
+			wantCode:   http.StatusBadRequest,
+			wantReason: metav1.StatusReasonBadRequest,
+		},
+		{
+			name: "failing mutation",
+			path: "/mutate",
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				return admissionReview(t, "Pod", "default", testPod(corev1.Container{Name: "app", Image: "nginx:1.19"}))
+			},
+			wantCode:   http.StatusInternalServerError,
+			wantReason: metav1.StatusReasonInternalError,
+		},
+		{
+			name: "service missing the required labels",
+			path: "/validate",
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				return admissionReview(t, "Service", "default", &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}})
+			},
+			wantCode:   http.StatusForbidden,
+			wantReason: metav1.StatusReasonForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "failurePolicy: Fail\n"))
+			whsvr.pipeline = []patchBuilder{failing}
+
+			var resp *v1beta1.AdmissionResponse
+			if test.path == "/mutate" {
+				resp = whsvr.mutate(context.Background(), test.review(t), "", true)
+			} else {
+				resp = whsvr.validate(test.review(t), true)
+			}
+			if resp.Allowed || resp.Result == nil {
+				t.Fatalf("response %+v, want a failure", resp)
+			}
+			if resp.Result.Code != test.wantCode || resp.Result.Reason != test.wantReason {
+				t.Errorf("status %d %s, want %d %s", resp.Result.Code, resp.Result.Reason, test.wantCode, test.wantReason)
+			}
+		})
+	}
+}
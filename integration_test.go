@@ -0,0 +1,123 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// Runs the webhook in process behind a kube-apiserver and etcd started by envtest, and checks the pods
+// the API server stores were mutated:
+//
+//	KUBEBUILDER_ASSETS=/usr/local/kubebuilder/bin go test -tags integration -run TestIntegration ./...
+func TestIntegrationMutatesStoredPods(t *testing.T) {
+	env := &envtest.Environment{}
+	restConfig, err := env.Start()
+	if err != nil {
+		t.Fatalf("Failed to start envtest, is KUBEBUILDER_ASSETS set? %v", err)
+	}
+	defer env.Stop()
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whsvr := newTestServer(t, testConfig(t, `
+volumes:
+  - name: certs
+    secret:
+      secretName: app-certs
+    mountPath: /etc/app-certs
+    readOnly: true
+`))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", whsvr.serve)
+	server := httptest.NewUnstartedServer(mux)
+	certificate, caBundle := selfSignedCertificate(t, "127.0.0.1")
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	defer server.Close()
+
+	ctx := context.Background()
+	url := server.URL + "/mutate"
+	failurePolicy := admissionregistrationv1beta1.Fail
+	sideEffects := admissionregistrationv1beta1.SideEffectClassNone
+	webhookConfiguration := &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "admission-webhook-example-integration"},
+		Webhooks: []admissionregistrationv1beta1.MutatingWebhook{{
+			Name:         "mutating.admission-webhook-example.banzaicloud.com",
+			ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{URL: &url, CABundle: caBundle},
+			Rules: []admissionregistrationv1beta1.RuleWithOperations{{
+				Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create},
+				Rule:       admissionregistrationv1beta1.Rule{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}},
+			}},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			AdmissionReviewVersions: []string{"v1beta1"},
+		}},
+	}
+	if _, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Create(ctx, webhookConfiguration, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "integration"}}
+	if _, err := client.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the API server picks up the webhook configuration asynchronously, pods created before are not mutated
+	var stored *corev1.Pod
+	attempt := 0
+	err = wait.PollImmediate(500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		attempt++
+		pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+		pod.Name, pod.Namespace = fmt.Sprintf("app-%d", attempt), namespace.Name
+		created, err := client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+		if err != nil {
+			return false, err
+		}
+		if len(created.Annotations[admissionWebhookAnnotationStatusKey]) == 0 {
+			return false, client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		}
+		// read back what was persisted rather than trusting the create response
+		stored, err = client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatalf("No mutated pod stored: %v", err)
+	}
+
+	var volume *corev1.Volume
+	for i := range stored.Spec.Volumes {
+		if stored.Spec.Volumes[i].Name == "certs" {
+			volume = &stored.Spec.Volumes[i]
+		}
+	}
+	if volume == nil || volume.Secret == nil || volume.Secret.SecretName != "app-certs" {
+		t.Fatalf("secret volume not injected into %v", stored.Spec.Volumes)
+	}
+	var mounted bool
+	for _, mount := range stored.Spec.Containers[0].VolumeMounts {
+		mounted = mounted || (mount.Name == "certs" && mount.MountPath == "/etc/app-certs" && mount.ReadOnly)
+	}
+	if !mounted {
+		t.Errorf("secret volume not mounted into the app container: %v", stored.Spec.Containers[0].VolumeMounts)
+	}
+}
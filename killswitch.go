@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Emergency pass-through: mutate() admits every request unmutated while the switch file contains
+// "true". The file is polled, so that a ConfigMap key mounted as the file toggles the switch without
+// a redeploy, a missing file leaves the switch off.
+type killSwitch struct {
+	path   string
+	active int32 // 1 while on, accessed atomically
+}
+
+func newKillSwitch(path string, interval time.Duration, stopCh <-chan struct{}) *killSwitch {
+	k := &killSwitch{path: path}
+	k.poll()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				k.poll()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return k
+}
+
+func (k *killSwitch) on() bool {
+	return atomic.LoadInt32(&k.active) == 1
+}
+
+func (k *killSwitch) poll() {
+	var active int32
+	data, err := ioutil.ReadFile(k.path)
+	switch {
+	case err == nil:
+		if strings.EqualFold(strings.TrimSpace(string(data)), "true") {
+			active = 1
+		}
+	case !os.IsNotExist(err):
+		// keep the current state rather than flapping on a transient read error
+		glog.Errorf("Can't read kill switch %s: %v", k.path, err)
+		return
+	}
+	if atomic.SwapInt32(&k.active, active) != active {
+		if active == 1 {
+			glog.Warningf("Kill switch %s on, admitting every request unmutated", k.path)
+		} else {
+			glog.Infof("Kill switch %s off, mutating requests again", k.path)
+		}
+	}
+	killSwitchActive.Set(float64(active))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestKillSwitchPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kill-switch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "on")
+
+	whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+	whsvr.killSwitch = &killSwitch{path: path}
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	check := func(wantOn bool) {
+		t.Helper()
+		whsvr.killSwitch.poll()
+		if on := whsvr.killSwitch.on(); on != wantOn {
+			t.Fatalf("kill switch on %v, want %v", on, wantOn)
+		}
+		wantGauge := 0.0
+		if wantOn {
+			wantGauge = 1
+		}
+		if gauge := testutil.ToFloat64(killSwitchActive); gauge != wantGauge {
+			t.Errorf("admission_webhook_kill_switch_active %v, want %v", gauge, wantGauge)
+		}
+		resp := whsvr.mutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+		if !resp.Allowed {
+			t.Fatalf("pod denied: %v", resp.Result)
+		}
+		if mutated := resp.Patch != nil; mutated == wantOn {
+			t.Errorf("patch %s with the kill switch on %v", resp.Patch, wantOn)
+		}
+	}
+
+	// a missing file leaves the switch off
+	check(false)
+	if err := ioutil.WriteFile(path, []byte("true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+}
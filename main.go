@@ -3,51 +3,216 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
 )
 
+// webhook build, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	var parameters WhSvrParameters
 
 	// get command line parameters
-	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
-	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
-	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	registerFlags(flag.CommandLine, &parameters)
 	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		glog.Fatalf("Failed to read flags from the environment: %v", err)
+	}
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	setAnnotationPrefix(parameters.annotationPrefix)
+
+	if parameters.patchWorkers < 1 {
+		glog.Fatal("--patchWorkers must be at least 1")
+	}
+	if parameters.killSwitchFile != "" && parameters.killSwitchInterval <= 0 {
+		glog.Fatal("--killSwitchInterval must be positive")
+	}
+
+	podSelector, err := labels.Parse(parameters.podSelector)
 	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+		glog.Fatalf("Failed to parse --podSelector: %v", err)
+	}
+
+	var allowedClientCNs []string
+	if parameters.allowedClientCNs != "" {
+		allowedClientCNs = strings.Split(parameters.allowedClientCNs, ",")
+	}
+	if len(allowedClientCNs) > 0 && parameters.clientCAFile == "" {
+		glog.Fatal("--allowedClientCNs requires --clientCAFile")
+	}
+
+	config, err := loadConfig(parameters.configFile)
+	if err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	whsvr := &WebhookServer{
-		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
-		},
+		server:           newHTTPServer(parameters),
+		config:           config,
+		force:            parameters.force,
+		logSampleRate:    parameters.logSampleRate,
+		allowedClientCNs: allowedClientCNs,
+		responseDelay:    parameters.responseDelay,
+		gzipMinBytes:     parameters.gzipMinBytes,
+		patchPool:        newWorkerPool(parameters.patchWorkers),
+		podSelector:      podSelector,
+		pretty:           parameters.pretty,
+		maxRequestBytes:  parameters.maxRequestBytes,
+		parameters:       parameters,
 	}
 
-	// define http server and server handler
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
-	mux.HandleFunc("/validate", whsvr.serve)
-	whsvr.server.Handler = mux
+	if err := whsvr.checkRuleModes(); err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := whsvr.checkCanary(); err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := whsvr.checkPipeline(); err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := whsvr.checkProfiles(); err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// printing the configuration reads nothing but the configuration file, so it works without the mounted
+	// certificates and tokens, and opens no file, listener or cluster connection
+	if parameters.printConfig != "" {
+		out, err := whsvr.marshalEffectiveConfig(parameters.printConfig)
+		if err != nil {
+			glog.Fatalf("Failed to print configuration: %v", err)
+		}
+		os.Stdout.Write(out)
+		if parameters.printConfig == "json" {
+			fmt.Println()
+		}
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	if err != nil {
+		glog.Fatalf("Failed to load key pair: %v", err)
+	}
+
+	if whsvr.adminToken, err = readTokenFile(parameters.adminTokenFile); err != nil {
+		glog.Fatalf("Failed to read admin token: %v", err)
+	}
+	if whsvr.apiServerToken, err = readTokenFile(parameters.apiServerTokenFile); err != nil {
+		glog.Fatalf("Failed to read API server token: %v", err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if len(config.SNICertificates) > 0 {
+		certificates, err := loadSNICertificates(config.SNICertificates)
+		if err != nil {
+			glog.Fatalf("Failed to load SNI certificates: %v", err)
+		}
+		tlsConfig.GetCertificate = sniGetCertificate(certificates)
+	}
+	if parameters.clientCAFile != "" {
+		caCerts, err := ioutil.ReadFile(parameters.clientCAFile)
+		if err != nil {
+			glog.Fatalf("Failed to read client CA certificates: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCerts) {
+			glog.Fatalf("No certificates found in %s", parameters.clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	whsvr.server.TLSConfig = tlsConfig
+
+	if parameters.decisionLogFile != "" {
+		whsvr.decisionLog, err = newDecisionLog(parameters.decisionLogFile, parameters.decisionLogMaxSize)
+		if err != nil {
+			glog.Fatalf("Failed to open decision log: %v", err)
+		}
+	}
+
+	if len(pair.Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil {
+			whsvr.certNotAfter = leaf.NotAfter
+			certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+		}
+	}
+
+	if parameters.breakerErrors > 0 {
+		whsvr.breaker = newCircuitBreaker(parameters.breakerErrors, parameters.breakerWindow, parameters.breakerCooldown)
+	}
+
+	// the in-cluster client is only created when a policy needs it
+	var client kubernetes.Interface
+	clusterClient := func() kubernetes.Interface {
+		if client == nil {
+			if client, err = newClientset(); err != nil {
+				glog.Fatalf("Failed to create Kubernetes client: %v", err)
+			}
+		}
+		return client
+	}
+
+	stopCh := make(chan struct{})
+	if name := config.RequiredSecret.Name; name != "" {
+		whsvr.client = clusterClient()
+		if whsvr.secretLister, err = newSecretLister(whsvr.client, name, stopCh); err != nil {
+			glog.Fatalf("Failed to cache the required secrets: %v", err)
+		}
+	}
+	if (config.DefaultServiceAccount.Enabled && config.DefaultServiceAccount.NamespaceSelector != "") || config.SkipTerminatingNamespaces {
+		whsvr.client = clusterClient()
+		if whsvr.namespaceLister, err = newNamespaceLister(whsvr.client, stopCh); err != nil {
+			glog.Fatalf("Failed to cache the namespaces: %v", err)
+		}
+	}
+	if parameters.killSwitchFile != "" {
+		whsvr.killSwitch = newKillSwitch(parameters.killSwitchFile, parameters.killSwitchInterval, stopCh)
+	}
+	if config.NativeSidecars && len(config.Sidecars) > 0 {
+		supported, err := nativeSidecarsSupported(clusterClient())
+		if err != nil {
+			glog.Fatalf("Failed to get the Kubernetes version: %v", err)
+		}
+		if !supported {
+			glog.Warningf("Native sidecars need Kubernetes %v or later, injecting the sidecars as app containers", nativeSidecarsVersion)
+		}
+		whsvr.nativeSidecars = supported
+	}
+
+	whsvr.server.Handler = whsvr.newMux()
+
+	// only listen once the configuration, certificates and caches are loaded, so that no request is
+	// answered before, and exit when the port can't be bound
+	listener, err := net.Listen("tcp", whsvr.server.Addr)
+	if err != nil {
+		glog.Fatalf("Failed to listen: %v", err)
+	}
+	whsvr.setReady(true)
 
 	// start webhook server in new routine
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
+		if err := whsvr.server.ServeTLS(listener, "", ""); err != nil {
 			glog.Errorf("Failed to listen and serve webhook server: %v", err)
 		}
 	}()
 
-	glog.Info("Server started")
+	glog.Infof("Server %s started", version)
 
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
@@ -55,5 +220,140 @@ func main() {
 	<-signalChan
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
+	whsvr.setReady(false)
+	close(stopCh)
 	whsvr.server.Shutdown(context.Background())
+	if whsvr.decisionLog != nil {
+		whsvr.decisionLog.close()
+	}
+}
+
+// define the command line flags of the parameters, each also read from its WEBHOOK_* environment variable
+func registerFlags(flags *flag.FlagSet, parameters *WhSvrParameters) {
+	flags.IntVar(&parameters.port, "port", 443, "Webhook server port.")
+	flags.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
+	flags.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flags.StringVar(&parameters.configFile, "configFile", "", "File containing the webhook policy configuration.")
+	flags.BoolVar(&parameters.force, "force", false, "Overwrite values already set on mutated objects.")
+	flags.IntVar(&parameters.logSampleRate, "logSampleRate", 1, "Log 1 in N admission requests at info level, errors are always logged.")
+	flags.StringVar(&parameters.adminTokenFile, "adminTokenFile", "", "File containing the bearer token for the /config endpoint, disabled when unset.")
+	flags.StringVar(&parameters.annotationPrefix, "annotationPrefix", defaultAnnotationPrefix, "Domain of the webhook annotation keys.")
+	flags.StringVar(&parameters.apiServerTokenFile, "apiServerTokenFile", "", "File containing the bearer token admission requests must present, not required when unset.")
+	flags.StringVar(&parameters.clientCAFile, "clientCAFile", "", "File containing the CA certificates verifying admission client certificates.")
+	flags.StringVar(&parameters.allowedClientCNs, "allowedClientCNs", "", "Comma separated common names of the client certificates allowed to send admission requests, requires --clientCAFile.")
+	flags.DurationVar(&parameters.responseDelay, "responseDelay", 0, "Testing only: delay every mutate response, e.g. to exercise the webhook timeoutSeconds and failurePolicy.")
+	flags.IntVar(&parameters.gzipMinBytes, "gzipMinBytes", 0, "Gzip response bodies of at least this many bytes when the caller accepts it, disabled when 0.")
+	flags.StringVar(&parameters.decisionLogFile, "decisionLogFile", "", "File appending every admission decision as a JSON line, disabled when unset.")
+	flags.Int64Var(&parameters.decisionLogMaxSize, "decisionLogMaxSize", 10<<20, "Size in bytes at which --decisionLogFile is rotated to <file>.1, never rotated when 0.")
+	flags.IntVar(&parameters.patchWorkers, "patchWorkers", runtime.GOMAXPROCS(0), "Number of patches computed concurrently, defaults to GOMAXPROCS.")
+	flags.StringVar(&parameters.podSelector, "podSelector", "", "Label selector of the pods to mutate, e.g. app=web,tier!=db, every pod when unset.")
+	flags.BoolVar(&parameters.pretty, "pretty", false, "Debugging only: indent the JSON responses.")
+	flags.DurationVar(&parameters.readTimeout, "readTimeout", 10*time.Second, "Maximum duration for reading a request, including its body.")
+	flags.DurationVar(&parameters.writeTimeout, "writeTimeout", 35*time.Second, "Maximum duration before timing out the write of a response, above the 30s webhook timeout limit.")
+	flags.DurationVar(&parameters.idleTimeout, "idleTimeout", 120*time.Second, "Maximum duration to wait for the next request on a keep-alive connection.")
+	flags.IntVar(&parameters.maxHeaderBytes, "maxHeaderBytes", http.DefaultMaxHeaderBytes, "Maximum size of the request headers.")
+	flags.Int64Var(&parameters.maxRequestBytes, "maxRequestBytes", 6<<20, "Maximum size of an admission request body, chunked or not, no limit when 0. Reviews of updates carry two objects of up to 3MB each.")
+	flags.IntVar(&parameters.breakerErrors, "breakerErrors", 0, "Internal mutate errors within --breakerWindow after which requests are admitted unmutated, disabled when 0.")
+	flags.DurationVar(&parameters.breakerWindow, "breakerWindow", time.Minute, "Window in which --breakerErrors trip the circuit breaker.")
+	flags.DurationVar(&parameters.breakerCooldown, "breakerCooldown", 30*time.Second, "Time the circuit breaker stays open, doubled on repeated trips up to 10m.")
+	flags.StringVar(&parameters.killSwitchFile, "killSwitchFile", "", "File, e.g. a mounted ConfigMap key, admitting every request unmutated while it contains true, disabled when unset.")
+	flags.DurationVar(&parameters.killSwitchInterval, "killSwitchInterval", 5*time.Second, "How often --killSwitchFile is read.")
+	flags.StringVar(&parameters.printConfig, "printConfig", "", "Print the effective configuration, after defaults, file, environment and flags, as json or yaml and exit.")
+}
+
+// http server on the webhook port, timing out slow clients
+func newHTTPServer(parameters WhSvrParameters) *http.Server {
+	return &http.Server{
+		Addr:           fmt.Sprintf(":%v", parameters.port),
+		ReadTimeout:    parameters.readTimeout,
+		WriteTimeout:   parameters.writeTimeout,
+		IdleTimeout:    parameters.idleTimeout,
+		MaxHeaderBytes: parameters.maxHeaderBytes,
+	}
+}
+
+// handler of the admission, metrics, status and root paths
+func (whsvr *WebhookServer) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", whsvr.afterStartup(whsvr.authorize(whsvr.serve)))
+	mux.HandleFunc("/validate", whsvr.afterStartup(whsvr.authorize(whsvr.serve)))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/config", whsvr.serveConfig)
+	mux.HandleFunc("/healthz", whsvr.serveHealthz)
+	mux.HandleFunc("/readyz", whsvr.serveReadyz)
+	mux.HandleFunc("/", serveRoot)
+	return mux
+}
+
+// Every flag not given on the command line falls back to the environment variable WEBHOOK_<FLAG>,
+// with the flag name in upper snake case, e.g. WEBHOOK_TLS_CERT_FILE for --tlsCertFile
+func setFlagsFromEnv(flags *flag.FlagSet) error {
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		key := flagEnvName(f.Name)
+		if value, ok := os.LookupEnv(key); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, key, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// environment variable of the flag, acronyms stay together: clientCAFile is WEBHOOK_CLIENT_CA_FILE
+func flagEnvName(name string) string {
+	runes := []rune(name)
+	var key []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			// an acronym ends before a capitalized word, its plural "s" (allowedClientCNs) does not start one
+			endsAcronym := unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !(i+2 == len(runes) && runes[i+1] == 's')
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || endsAcronym {
+				key = append(key, '_')
+			}
+		}
+		key = append(key, unicode.ToUpper(r))
+	}
+	return "WEBHOOK_" + string(key)
+}
+
+// token stored in the file, "" when no file is given
+func readTokenFile(tokenFile string) (string, error) {
+	if tokenFile == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// key pairs by lower case server name
+func loadSNICertificates(snis []SNICertificate) (map[string]*tls.Certificate, error) {
+	certificates := make(map[string]*tls.Certificate, len(snis))
+	for _, sni := range snis {
+		pair, err := tls.LoadX509KeyPair(sni.CertFile, sni.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sni.ServerName, err)
+		}
+		certificates[strings.ToLower(sni.ServerName)] = &pair
+	}
+	return certificates, nil
+}
+
+// select the key pair of the requested server name, nil falls back to --tlsCertFile
+func sniGetCertificate(certificates map[string]*tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certificates[strings.ToLower(hello.ServerName)], nil
+	}
 }
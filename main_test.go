@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PEM encoded self-signed serving certificate and key of the host, an IP address or DNS name
+func selfSignedPEM(t *testing.T, host string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serving certificate of the host and the CA bundle trusting it
+func selfSignedCertificate(t *testing.T, host string) (tls.Certificate, []byte) {
+	t.Helper()
+	certPEM, keyPEM := selfSignedPEM(t, host)
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, certPEM
+}
+
+// files holding a self-signed certificate and key of the host, removed after the test
+func certificateFiles(t *testing.T, host string) (certFile, keyFile string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "certs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certPEM, keyPEM := selfSignedPEM(t, host)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestFlagEnvName(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{flag: "port", want: "WEBHOOK_PORT"},
+		{flag: "tlsCertFile", want: "WEBHOOK_TLS_CERT_FILE"},
+		{flag: "apiServerTokenFile", want: "WEBHOOK_API_SERVER_TOKEN_FILE"},
+		{flag: "allowedClientCNs", want: "WEBHOOK_ALLOWED_CLIENT_CNS"},
+		{flag: "clientCAFile", want: "WEBHOOK_CLIENT_CA_FILE"},
+		{flag: "gzipMinBytes", want: "WEBHOOK_GZIP_MIN_BYTES"},
+		{flag: "printConfig", want: "WEBHOOK_PRINT_CONFIG"},
+	}
+	for _, test := range tests {
+		if got := flagEnvName(test.flag); got != test.want {
+			t.Errorf("flagEnvName(%q) = %s, want %s", test.flag, got, test.want)
+		}
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := flags.Int("port", 443, "")
+	delay := flags.Duration("responseDelay", 0, "")
+	force := flags.Bool("force", false, "")
+	os.Setenv("WEBHOOK_PORT", "8443")
+	os.Setenv("WEBHOOK_RESPONSE_DELAY", "2s")
+	os.Setenv("WEBHOOK_FORCE", "true")
+	defer func() {
+		os.Unsetenv("WEBHOOK_PORT")
+		os.Unsetenv("WEBHOOK_RESPONSE_DELAY")
+		os.Unsetenv("WEBHOOK_FORCE")
+	}()
+
+	// flags given on the command line win over the environment
+	if err := flags.Parse([]string{"-force=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 8443 || *delay != 2*time.Second || *force {
+		t.Errorf("port %d, responseDelay %v, force %v, want 8443, 2s, false", *port, *delay, *force)
+	}
+
+	os.Setenv("WEBHOOK_PORT", "https")
+	invalid := flag.NewFlagSet("invalid", flag.ContinueOnError)
+	invalid.Int("port", 443, "")
+	if err := setFlagsFromEnv(invalid); err == nil {
+		t.Error("invalid WEBHOOK_PORT accepted")
+	}
+}
+
+func TestSNIGetCertificate(t *testing.T) {
+	var snis []SNICertificate
+	for _, host := range []string{"webhook.default.svc", "webhook.example.com"} {
+		certFile, keyFile := certificateFiles(t, host)
+		snis = append(snis, SNICertificate{ServerName: host, CertFile: certFile, KeyFile: keyFile})
+	}
+	certificates, err := loadSNICertificates(snis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCertificate := sniGetCertificate(certificates)
+
+	tests := []struct {
+		serverName string
+		want       string // common name of the selected certificate, none for the --tlsCertFile fallback
+	}{
+		{serverName: "webhook.default.svc", want: "webhook.default.svc"},
+		{serverName: "Webhook.Example.com", want: "webhook.example.com"},
+		{serverName: "other.example.com"},
+		{serverName: ""},
+	}
+	for _, test := range tests {
+		certificate, err := getCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatalf("%q: %v", test.serverName, err)
+		}
+		if test.want == "" {
+			if certificate != nil {
+				t.Errorf("%q: certificate selected, want the fallback", test.serverName)
+			}
+			continue
+		}
+		if certificate == nil {
+			t.Errorf("%q: no certificate, want %s", test.serverName, test.want)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != test.want {
+			t.Errorf("%q: certificate of %s, want %s", test.serverName, leaf.Subject.CommonName, test.want)
+		}
+	}
+}
+
+func TestSlowClientTimedOut(t *testing.T) {
+	readTimeout := 200 * time.Millisecond
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer(WhSvrParameters{readTimeout: readTimeout, maxHeaderBytes: http.DefaultMaxHeaderBytes})
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request with unfinished headers served")
+	})
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Write([]byte("POST /mutate HTTP/1.1\r\nHost: webhook\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers never end, the server closes the connection once readTimeout passes
+	conn.SetReadDeadline(time.Now().Add(readTimeout + 5*time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < readTimeout {
+		t.Errorf("connection closed after %v, before the %v read timeout", elapsed, readTimeout)
+	}
+}
+
+func TestMuxRoutes(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+	whsvr.setReady(true)
+	mux := whsvr.newMux()
+
+	tests := []struct {
+		name     string
+		request  func(t *testing.T) *http.Request
+		wantCode int
+	}{
+		{
+			name:     "root",
+			request:  func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "root posted",
+			request:  func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodPost, "/", nil) },
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "unregistered path",
+			request:  func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodGet, "/unknown", nil) },
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name: "mutate",
+			request: func(t *testing.T) *http.Request {
+				pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+				return reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod))
+			},
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := test.request(t)
+			mux.ServeHTTP(w, r)
+			if w.Code != test.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, test.wantCode)
+			}
+			if r.URL.Path != "/mutate" {
+				return
+			}
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("invalid review %s: %v", w.Body, err)
+			}
+			if review.Response == nil || !review.Response.Allowed || len(review.Response.Patch) == 0 {
+				t.Errorf("response %+v, want the pod allowed and patched", review.Response)
+			}
+		})
+	}
+}
+
+func TestEffectiveConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		"WEBHOOK_PORT":          "8443",
+		"WEBHOOK_TLS_CERT_FILE": "/etc/tls/cert.pem",
+		"WEBHOOK_READ_TIMEOUT":  "5s",
+		"WEBHOOK_FORCE":         "true",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	var parameters WhSvrParameters
+	flags := flag.NewFlagSet("admission-webhook", flag.ContinueOnError)
+	registerFlags(flags, &parameters)
+	// a flag given on the command line wins over the environment
+	if err := flags.Parse([]string{"-port=9443"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	whsvr := newTestServer(t, testConfig(t, ""))
+	whsvr.force = parameters.force
+	whsvr.parameters = parameters
+
+	out, err := whsvr.marshalEffectiveConfig("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid json %s: %v", out, err)
+	}
+	want := map[string]interface{}{
+		"port":        9443.0,
+		"tlsCertFile": "/etc/tls/cert.pem",
+		"readTimeout": "5s",
+		"force":       true,
+		"tlsKeyFile":  "/etc/webhook/certs/key.pem",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s is %v, want %v", key, got[key], value)
+		}
+	}
+}
+
+func TestMuxStartup(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+	mux := whsvr.newMux()
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	probe := func(wantReadyz, wantMutate int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != wantReadyz {
+			t.Errorf("/readyz status %d, want %d", w.Code, wantReadyz)
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod)))
+		if w.Code != wantMutate {
+			t.Errorf("/mutate status %d, want %d", w.Code, wantMutate)
+		}
+	}
+
+	// before the configuration, certificates and caches are loaded
+	probe(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	whsvr.setReady(true)
+	probe(http.StatusOK, http.StatusOK)
+	// shutdown begins, admission requests are still answered while the endpoint drains
+	whsvr.setReady(false)
+	probe(http.StatusServiceUnavailable, http.StatusOK)
+}
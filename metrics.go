@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	patchSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "admission_webhook_patch_size_bytes",
+		Help:    "Size of the serialized JSON patches returned by the mutating webhook.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	})
+	patchOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_webhook_patch_operations_total",
+		Help: "Number of JSON patch operations returned by the mutating webhook, by operation type.",
+	}, []string{"op"})
+	validationDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_validation_denials_total",
+		Help: "Number of pods denied by each validation rule, a pod denied by several rules counts for each of them.",
+	}, []string{"rule"})
+	killSwitchActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "admission_webhook_kill_switch_active",
+		Help: "1 while the kill switch makes the mutating webhook admit every request unmutated.",
+	})
+	certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "admission_webhook_certificate_expiry_timestamp_seconds",
+		Help: "Unix time at which the serving certificate expires.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(patchSizeBytes, patchOperations, validationDenials, killSwitchActive, certificateExpiry)
+}
+
+func observePatch(patch []patchOperation, patchBytes []byte) {
+	patchSizeBytes.Observe(float64(len(patchBytes)))
+	for _, operation := range patch {
+		patchOperations.WithLabelValues(operation.Op).Inc()
+	}
+}
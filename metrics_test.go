@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// sample count and sum of the patch size histogram
+func patchSizeSamples(t *testing.T) (uint64, float64) {
+	t.Helper()
+	var metric dto.Metric
+	if err := patchSizeBytes.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+func TestObservePatch(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n  tier: web\n"))
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	pod.Labels = map[string]string{"team": "web"}
+	adds := testutil.ToFloat64(patchOperations.WithLabelValues("add"))
+	count, sum := patchSizeSamples(t)
+
+	patch, err := whsvr.createPatch("Pod", &podMutation{pod: pod, namespace: pod.Namespace, uid: "test"}, nil,
+		map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the status annotations and the missing tier label
+	if got := testutil.ToFloat64(patchOperations.WithLabelValues("add")); got != adds+2 {
+		t.Errorf("%v add operations counted, want %v", got, adds+2)
+	}
+	gotCount, gotSum := patchSizeSamples(t)
+	if gotCount != count+1 || gotSum != sum+float64(len(patch)) {
+		t.Errorf("%d samples summing to %v, want %d summing to %v", gotCount, gotSum, count+1, sum+float64(len(patch)))
+	}
+}
+
+func BenchmarkCreatePatch(b *testing.B) {
+	whsvr := newTestServer(b, testConfig(b, "podLabels:\n  team: platform\n"+
+		"sidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\n"+
+		"volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n"+
+		"resourceDefaults:\n  requests:\n    ephemeral-storage: 256Mi\n"))
+	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the mutations record their changes on the pod
+		pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"}, corev1.Container{Name: "worker", Image: "worker:1.0"})
+		if _, err := whsvr.createPatch("Pod", &podMutation{pod: pod, namespace: pod.Namespace, uid: "test"}, nil, annotations, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+// Fixed number of workers running CPU bound tasks, such as computing patches, so that their
+// concurrency is bounded independently of the number of connections being served
+type workerPool struct {
+	tasks chan func()
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{tasks: make(chan func())}
+	for i := 0; i < size; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// run the task on the next free worker and wait for it to complete
+func (p *workerPool) do(task func()) {
+	done := make(chan struct{})
+	p.tasks <- func() {
+		defer close(done)
+		task()
+	}
+	<-done
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	const size, tasks = 3, 50
+	pool := newWorkerPool(size)
+	var running, peak, completed int32
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.do(func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&peak)
+					if n <= max || atomic.CompareAndSwapInt32(&peak, max, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				atomic.AddInt32(&completed, 1)
+			})
+		}()
+	}
+	wg.Wait()
+
+	if completed != tasks {
+		t.Errorf("%d tasks completed, want %d", completed, tasks)
+	}
+	if peak > size {
+		t.Errorf("%d tasks ran concurrently, want at most %d", peak, size)
+	}
+	if peak < 2 {
+		t.Errorf("%d tasks ran concurrently, want the workers used in parallel", peak)
+	}
+}
@@ -1,20 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
@@ -50,10 +68,28 @@ var (
 	}
 )
 
+// webhook annotation keys, all under the domain set by -annotationPrefix
+var (
+	annotationPrefix                      = defaultAnnotationPrefix
+	admissionWebhookAnnotationValidateKey = defaultAnnotationPrefix + "/validate"
+	admissionWebhookAnnotationMutateKey   = defaultAnnotationPrefix + "/mutate"
+	admissionWebhookAnnotationStatusKey   = defaultAnnotationPrefix + "/status"
+	admissionWebhookAnnotationReinjectKey = defaultAnnotationPrefix + "/force-reinject"
+	admissionWebhookAnnotationTopologyKey = defaultAnnotationPrefix + "/topology-spread"
+	admissionWebhookAnnotationMountKey    = defaultAnnotationPrefix + "/mount-path"
+	admissionWebhookAnnotationEnvFromKey  = defaultAnnotationPrefix + "/env-from"
+	admissionWebhookAnnotationRuntimeKey  = defaultAnnotationPrefix + "/runtime-class"
+	admissionWebhookAnnotationVersionKey  = defaultAnnotationPrefix + "/injected-by"
+	admissionWebhookAnnotationResourceKey = defaultAnnotationPrefix + "/resource-defaults"
+	admissionWebhookAnnotationDNSKey      = defaultAnnotationPrefix + "/dns"
+	admissionWebhookAnnotationStartupKey  = defaultAnnotationPrefix + "/startup-probe"
+	admissionWebhookAnnotationConfigKey   = defaultAnnotationPrefix + "/config-checksum"
+	admissionWebhookAnnotationZoneKey     = defaultAnnotationPrefix + "/zone"
+	admissionWebhookAnnotationImagesKey   = defaultAnnotationPrefix + "/sidecar-images"
+)
+
 const (
-	admissionWebhookAnnotationValidateKey = "admission-webhook-example.banzaicloud.com/validate"
-	admissionWebhookAnnotationMutateKey   = "admission-webhook-example.banzaicloud.com/mutate"
-	admissionWebhookAnnotationStatusKey   = "admission-webhook-example.banzaicloud.com/status"
+	defaultAnnotationPrefix = "admission-webhook-example.banzaicloud.com"
 
 	nameLabel      = "app.kubernetes.io/name"
 	instanceLabel  = "app.kubernetes.io/instance"
@@ -63,18 +99,91 @@ const (
 	managedByLabel = "app.kubernetes.io/managed-by"
 
 	NA = "not_available"
+
+	// request header selecting one of the configured profiles
+	profileHeader = "X-Webhook-Profile"
 )
 
 type WebhookServer struct {
-	server *http.Server
+	requestCount  uint64 // accessed atomically, keep 64-bit aligned
+	server        *http.Server
+	config        *Config
+	force         bool   // overwrite values already set on the object
+	logSampleRate int    // log 1 in logSampleRate requests at info level
+	adminToken    string // bearer token required by the /config endpoint, disabled when empty
+
+	// admission callers must present apiServerToken and a client certificate issued to one of
+	// allowedClientCNs, each check is skipped when unset
+	apiServerToken   string
+	allowedClientCNs []string
+
+	responseDelay time.Duration // artificial mutate() latency for testing webhook timeouts
+	gzipMinBytes  int           // gzip responses of at least gzipMinBytes to callers accepting it, disabled when <= 0
+	decisionLog   *decisionLog  // local audit trail of the decisions, disabled when nil
+	certNotAfter  time.Time     // expiry of the serving certificate, reported by /healthz
+	patchPool     *workerPool   // computes the patches of concurrent mutate requests
+
+	secretLister    corelisters.SecretLister    // set when a required secret is configured
+	namespaceLister corelisters.NamespaceLister // set when a policy needs the namespaces, e.g. their labels
+	client          kubernetes.Interface        // reads what the listers have not cached yet, set with them
+
+	nativeSidecars bool // nativeSidecars is configured and supported by the cluster
+
+	pipeline []patchBuilder // pod mutations in the order they run, set by checkPipeline
+
+	podSelector labels.Selector // pods mutated, in addition to the webhook objectSelector
+
+	pretty bool // indent JSON responses for debugging
+
+	maxRequestBytes int64 // admission requests with larger bodies are rejected, no limit when <= 0
+
+	breaker *circuitBreaker // fails mutate() open after repeated internal errors, disabled when nil
+
+	killSwitch *killSwitch // admits every request unmutated while on, disabled when nil
+
+	parameters WhSvrParameters // command line parameters the server was started with, reported by /config
+
+	ready   int32 // 1 between startup and shutdown, accessed atomically
+	started int32 // 1 once startup completed, kept during shutdown, accessed atomically
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
-	port           int    // webhook server port
-	certFile       string // path to the x509 certificate for https
-	keyFile        string // path to the x509 private key matching `CertFile`
-	sidecarCfgFile string // path to sidecar injector configuration file
+	port               int    // webhook server port
+	certFile           string // path to the x509 certificate for https
+	keyFile            string // path to the x509 private key matching `CertFile`
+	configFile         string // path to webhook policy configuration file
+	force              bool   // overwrite values already set on the object
+	logSampleRate      int    // log 1 in logSampleRate requests at info level
+	adminTokenFile     string // path to the bearer token required by the /config endpoint
+	annotationPrefix   string // domain of the webhook annotation keys
+	apiServerTokenFile string // path to the bearer token admission requests must present
+	clientCAFile       string // path to the CA certificates verifying client certificates
+	allowedClientCNs   string // comma separated client certificate common names allowed to call the webhook
+	responseDelay      time.Duration
+	gzipMinBytes       int    // smallest response body compressed with gzip, disabled when <= 0
+	decisionLogFile    string // path to the JSON lines file recording every decision, disabled when unset
+	decisionLogMaxSize int64  // size in bytes at which the decision log is rotated
+	patchWorkers       int    // number of patches computed concurrently
+	podSelector        string // label selector of the pods mutated, every pod when unset
+	pretty             bool   // indent JSON responses for debugging
+
+	// http.Server tuning, guarding against slow clients
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	maxHeaderBytes  int
+	maxRequestBytes int64
+
+	killSwitchFile     string        // file holding "true" to turn the kill switch on, disabled when unset
+	killSwitchInterval time.Duration // how often the kill switch file is read
+
+	// circuit breaker failing mutate() open
+	breakerErrors   int
+	breakerWindow   time.Duration
+	breakerCooldown time.Duration
+
+	printConfig string // print the effective configuration in this format (json or yaml) and exit
 }
 
 type patchOperation struct {
@@ -91,11 +200,30 @@ func init() {
 	_ = v1.AddToScheme(runtimeScheme)
 }
 
-func admissionRequired(ignoredList []string, admissionAnnotationKey string, metadata *metav1.ObjectMeta) bool {
+func setAnnotationPrefix(prefix string) {
+	annotationPrefix = prefix
+	admissionWebhookAnnotationValidateKey = prefix + "/validate"
+	admissionWebhookAnnotationMutateKey = prefix + "/mutate"
+	admissionWebhookAnnotationStatusKey = prefix + "/status"
+	admissionWebhookAnnotationReinjectKey = prefix + "/force-reinject"
+	admissionWebhookAnnotationTopologyKey = prefix + "/topology-spread"
+	admissionWebhookAnnotationMountKey = prefix + "/mount-path"
+	admissionWebhookAnnotationEnvFromKey = prefix + "/env-from"
+	admissionWebhookAnnotationRuntimeKey = prefix + "/runtime-class"
+	admissionWebhookAnnotationVersionKey = prefix + "/injected-by"
+	admissionWebhookAnnotationResourceKey = prefix + "/resource-defaults"
+	admissionWebhookAnnotationDNSKey = prefix + "/dns"
+	admissionWebhookAnnotationStartupKey = prefix + "/startup-probe"
+	admissionWebhookAnnotationConfigKey = prefix + "/config-checksum"
+	admissionWebhookAnnotationZoneKey = prefix + "/zone"
+	admissionWebhookAnnotationImagesKey = prefix + "/sidecar-images"
+}
+
+func admissionRequired(ignoredList []string, admissionAnnotationKey string, metadata *metav1.ObjectMeta, log requestLog) bool {
 	// skip special kubernetes system namespaces
 	for _, namespace := range ignoredList {
 		if metadata.Namespace == namespace {
-			glog.Infof("Skip validation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
+			log.Infof("Skip validation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
 			return false
 		}
 	}
@@ -115,31 +243,37 @@ func admissionRequired(ignoredList []string, admissionAnnotationKey string, meta
 	return required
 }
 
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
-	required := admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata)
+func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log requestLog) bool {
+	required := admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata, log)
 	annotations := metadata.GetAnnotations()
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
 	status := annotations[admissionWebhookAnnotationStatusKey]
 
-	if strings.ToLower(status) == "mutated" {
+	// the force-reinject annotation bypasses the guard, e.g. to pick up a changed configuration
+	if strings.ToLower(status) == "mutated" && strings.ToLower(annotations[admissionWebhookAnnotationReinjectKey]) != "true" {
 		required = false
 	}
 
-	glog.Infof("Mutation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
+	log.Infof("Mutation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
 	return required
 }
 
-func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
-	required := admissionRequired(ignoredList, admissionWebhookAnnotationValidateKey, metadata)
-	glog.Infof("Validation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
+func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log requestLog) bool {
+	required := admissionRequired(ignoredList, admissionWebhookAnnotationValidateKey, metadata, log)
+	log.Infof("Validation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
 	return required
 }
 
+// escape a user controlled string used as a JSON patch path segment (RFC 6901)
+func jsonPointerEscape(segment string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(segment)
+}
+
 func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
 	for key, value := range added {
-		if target == nil || target[key] == "" {
+		if target == nil {
 			target = map[string]string{}
 			patch = append(patch, patchOperation{
 				Op:   "add",
@@ -149,9 +283,13 @@ func updateAnnotation(target map[string]string, added map[string]string) (patch
 				},
 			})
 		} else {
+			op := "add"
+			if target[key] != "" {
+				op = "replace"
+			}
 			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
+				Op:    op,
+				Path:  "/metadata/annotations/" + jsonPointerEscape(key),
 				Value: value,
 			})
 		}
@@ -159,219 +297,2319 @@ func updateAnnotation(target map[string]string, added map[string]string) (patch
 	return patch
 }
 
+// add the labels the object lacks, keeping its other labels, nothing when none is missing
 func updateLabels(target map[string]string, added map[string]string) (patch []patchOperation) {
-	values := make(map[string]string)
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			values[key] = value
+	var keys []string
+	for key := range added {
+		if target[key] == "" {
+			keys = append(keys, key)
 		}
 	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/labels",
-		Value: values,
-	})
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if target == nil {
+			target = map[string]string{}
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/labels",
+				Value: map[string]string{key: added[key]},
+			})
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/labels/" + jsonPointerEscape(key),
+			Value: added[key],
+		})
+	}
 	return patch
 }
 
-func createPatch(availableAnnotations map[string]string, annotations map[string]string, availableLabels map[string]string, labels map[string]string) ([]byte, error) {
-	var patch []patchOperation
+// add the configured labels to pods, keeping the value of existing keys unless -force is given
+func (whsvr *WebhookServer) addPodLabels(m *podMutation) (patch []patchOperation, err error) {
+	var keys []string
+	for key := range whsvr.config.PodLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	patch = append(patch, updateAnnotation(availableAnnotations, annotations)...)
-	patch = append(patch, updateLabels(availableLabels, labels)...)
+	for _, key := range keys {
+		value := whsvr.config.PodLabels[key]
+		existing, ok := m.pod.Labels[key]
+		if ok && (existing == value || !whsvr.force) {
+			continue
+		}
+		if m.pod.Labels == nil {
+			m.pod.Labels = map[string]string{}
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/labels",
+				Value: map[string]string{},
+			})
+		}
+		op := "add"
+		if ok {
+			op = "replace"
+		}
+		m.pod.Labels[key] = value
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  "/metadata/labels/" + jsonPointerEscape(key),
+			Value: value,
+		})
+	}
+	return patch, nil
+}
 
-	return json.Marshal(patch)
+// indexes of the containers mutations may target, leaving excluded containers (e.g. istio-proxy) untouched
+func (whsvr *WebhookServer) mutableContainers(m *podMutation, containers []corev1.Container) []int {
+	var indexes []int
+	for i, container := range containers {
+		if contains(whsvr.config.ExcludeContainers, container.Name) {
+			m.log.Infof("Container %s is excluded from mutation", container.Name)
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
 }
 
-// validate deployments and services
-func (whsvr *WebhookServer) validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
-	var (
-		availableLabels                 map[string]string
-		objectMeta                      *metav1.ObjectMeta
-		resourceNamespace, resourceName string
-	)
+// indexes of the mutable containers named in targets, every mutable container when targets is empty
+func (whsvr *WebhookServer) targetedContainers(m *podMutation, containers []corev1.Container, targets []string) []int {
+	var indexes []int
+	for _, i := range whsvr.mutableContainers(m, containers) {
+		if len(targets) == 0 || contains(targets, containers[i].Name) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
 
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
+// set the configured priority class on pods, keeping an existing one unless -force is given
+func (whsvr *WebhookServer) updatePriorityClassName(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	priorityClassName := whsvr.config.PriorityClassName
+	if priorityClassName == "" || spec.PriorityClassName == priorityClassName {
+		return patch, nil
+	}
 
-	switch req.Kind.Kind {
-	case "Deployment":
-		var deployment appsv1.Deployment
-		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+	op := "add"
+	if spec.PriorityClassName != "" {
+		if !whsvr.force {
+			return patch, nil
 		}
-		resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
-		availableLabels = deployment.Labels
-	case "Service":
-		var service corev1.Service
-		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+		op = "replace"
+	}
+	return append(patch, patchOperation{
+		Op:    op,
+		Path:  "/spec/priorityClassName",
+		Value: priorityClassName,
+	}), nil
+}
+
+// set the configured runtime class on pods of the targeted namespaces, an existing one is always kept
+func (whsvr *WebhookServer) updateRuntimeClassName(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	runtimeClass := whsvr.config.RuntimeClass
+	if runtimeClass.Name == "" || spec.RuntimeClassName != nil || m.optedOut(admissionWebhookAnnotationRuntimeKey) {
+		return patch, nil
+	}
+	if len(runtimeClass.Namespaces) > 0 && !contains(runtimeClass.Namespaces, m.namespace) {
+		return patch, nil
+	}
+
+	spec.RuntimeClassName = &runtimeClass.Name
+	return append(patch, patchOperation{
+		Op:    "add",
+		Path:  "/spec/runtimeClassName",
+		Value: runtimeClass.Name,
+	}), nil
+}
+
+// Pin pods requesting one of the configured zones via annotation to the nodes of the zone. The zone
+// requirement is added to every required node selector term, as the terms are ORed.
+func (whsvr *WebhookServer) addZoneAffinity(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	cfg := whsvr.config.ZoneAffinity
+	zone, ok := m.pod.Annotations[admissionWebhookAnnotationZoneKey]
+	if !ok {
+		return patch, nil
+	}
+	if !contains(cfg.Zones, zone) {
+		m.warn("ignoring %s annotation %q, the zone must be one of %s", admissionWebhookAnnotationZoneKey, zone, strings.Join(cfg.Zones, ", "))
+		return patch, nil
+	}
+
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      cfg.TopologyKey,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{zone},
+	}
+	term := corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{requirement}}
+	required := &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}}
+	switch {
+	case spec.Affinity == nil:
+		spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required}}
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/affinity",
+			Value: spec.Affinity,
+		}), nil
+	case spec.Affinity.NodeAffinity == nil:
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required}
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/affinity/nodeAffinity",
+			Value: spec.Affinity.NodeAffinity,
+		}), nil
+	case spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil ||
+		len(spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0:
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution",
+			Value: required,
+		}), nil
+	}
+
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for i := range terms {
+		if hasNodeSelectorRequirement(terms[i].MatchExpressions, requirement) {
+			continue
 		}
-		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
-		availableLabels = service.Labels
+		expressionsPath := fmt.Sprintf("/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/%d/matchExpressions", i)
+		if len(terms[i].MatchExpressions) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  expressionsPath,
+				Value: []corev1.NodeSelectorRequirement{requirement},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  expressionsPath + "/-",
+				Value: requirement,
+			})
+		}
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, requirement)
 	}
+	return patch, nil
+}
 
-	if !validationRequired(ignoredNamespaces, objectMeta) {
-		glog.Infof("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName)
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+func hasNodeSelectorRequirement(requirements []corev1.NodeSelectorRequirement, requirement corev1.NodeSelectorRequirement) bool {
+	for _, existing := range requirements {
+		if existing.Key == requirement.Key && existing.Operator == requirement.Operator &&
+			len(existing.Values) == 1 && existing.Values[0] == requirement.Values[0] {
+			return true
 		}
 	}
+	return false
+}
 
-	allowed := true
-	var result *metav1.Status
-	glog.Info("available labels:", availableLabels)
-	glog.Info("required labels", requiredLabels)
-	for _, rl := range requiredLabels {
-		if _, ok := availableLabels[rl]; !ok {
-			allowed = false
-			result = &metav1.Status{
-				Reason: "required labels are not set",
-			}
-			break
+// set the configured DNS policy and config on pods which do not set them, unless the pod opts out
+// via annotation. The API server defaults the policy to ClusterFirst, which is kept.
+func (whsvr *WebhookServer) updateDNS(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	dns := whsvr.config.DNS
+	if m.optedOut(admissionWebhookAnnotationDNSKey) {
+		return patch, nil
+	}
+
+	if dns.Config != nil && spec.DNSConfig == nil {
+		spec.DNSConfig = dns.Config.DeepCopy()
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/dnsConfig",
+			Value: dns.Config,
+		})
+	}
+	if dns.Policy != "" && spec.DNSPolicy == "" {
+		spec.DNSPolicy = dns.Policy
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/dnsPolicy",
+			Value: dns.Policy,
+		})
+	}
+	return patch, nil
+}
+
+// merge the configured tolerations into pods, skipping those the pod already has
+func (whsvr *WebhookServer) addTolerations(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	for _, toleration := range whsvr.config.Tolerations {
+		if hasToleration(spec.Tolerations, toleration) {
+			continue
+		}
+		if len(spec.Tolerations) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/tolerations",
+				Value: []corev1.Toleration{toleration},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/tolerations/-",
+				Value: toleration,
+			})
 		}
+		spec.Tolerations = append(spec.Tolerations, toleration)
 	}
+	return patch, nil
+}
 
-	return &v1beta1.AdmissionResponse{
-		Allowed: allowed,
-		Result:  result,
+func hasToleration(target []corev1.Toleration, toleration corev1.Toleration) bool {
+	for i := range target {
+		if target[i].MatchToleration(&toleration) {
+			return true
+		}
 	}
+	return false
 }
 
-// main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
-	var (
-		availableLabels, availableAnnotations map[string]string
-		objectMeta                            *metav1.ObjectMeta
-		resourceNamespace, resourceName       string
-	)
+// set the configured termination grace period on pods without one, and raise lower values to the configured
+// minimum, e.g. for sidecars needing time to flush. A higher value set by the user is never reduced.
+// The API server defaults the field before admission, so the default only applies when the request carries none.
+func (whsvr *WebhookServer) updateTerminationGracePeriod(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	seconds := spec.TerminationGracePeriodSeconds
+	if seconds == nil {
+		seconds = whsvr.config.TerminationGracePeriodSeconds
+	}
+	if minimum := whsvr.config.MinTerminationGracePeriodSeconds; minimum != nil && (seconds == nil || *seconds < *minimum) {
+		seconds = minimum
+	}
+	if seconds == nil || (spec.TerminationGracePeriodSeconds != nil && *spec.TerminationGracePeriodSeconds == *seconds) {
+		return patch, nil
+	}
 
-	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
+	op := "add"
+	if spec.TerminationGracePeriodSeconds != nil {
+		op = "replace"
+	}
+	value := *seconds
+	spec.TerminationGracePeriodSeconds = &value
+	return append(patch, patchOperation{
+		Op:    op,
+		Path:  "/spec/terminationGracePeriodSeconds",
+		Value: value,
+	}), nil
+}
 
-	switch req.Kind.Kind {
-	case "Deployment":
-		var deployment appsv1.Deployment
-		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+// set the configured fsGroup on pods without one, merged into an existing pod securityContext
+func (whsvr *WebhookServer) updateFSGroup(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	fsGroup := whsvr.config.FSGroup
+	if fsGroup == nil {
+		return patch, nil
+	}
+
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = &corev1.PodSecurityContext{FSGroup: fsGroup}
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/securityContext",
+			Value: corev1.PodSecurityContext{FSGroup: fsGroup},
+		}), nil
+	}
+	if spec.SecurityContext.FSGroup != nil {
+		return patch, nil
+	}
+	spec.SecurityContext.FSGroup = fsGroup
+	return append(patch, patchOperation{
+		Op:    "add",
+		Path:  "/spec/securityContext/fsGroup",
+		Value: *fsGroup,
+	}), nil
+}
+
+// Set the configured imagePullPolicy on the containers which don't specify one. The API server defaults
+// the policy from the image tag before admission, so a policy equal to that default counts as unspecified.
+func (whsvr *WebhookServer) updateImagePullPolicy(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	patch = append(patch, whsvr.defaultPullPolicy(m, "/spec/initContainers", spec.InitContainers)...)
+	patch = append(patch, whsvr.defaultPullPolicy(m, "/spec/containers", spec.Containers)...)
+	return patch, nil
+}
+
+func (whsvr *WebhookServer) defaultPullPolicy(m *podMutation, path string, containers []corev1.Container) (patch []patchOperation) {
+	policy := whsvr.config.ImagePullPolicy
+	for _, i := range whsvr.mutableContainers(m, containers) {
+		container := &containers[i]
+		if container.ImagePullPolicy == policy {
+			continue
 		}
-		resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
-		availableLabels = deployment.Labels
-	case "Service":
-		var service corev1.Service
-		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
+		op := "add"
+		if container.ImagePullPolicy != "" {
+			if container.ImagePullPolicy != tagPullPolicy(container.Image) {
+				continue
 			}
+			op = "replace"
 		}
-		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
-		availableLabels = service.Labels
+		container.ImagePullPolicy = policy
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  fmt.Sprintf("%s/%d/imagePullPolicy", path, i),
+			Value: policy,
+		})
 	}
+	return patch
+}
 
-	if !mutationRequired(ignoredNamespaces, objectMeta) {
-		glog.Infof("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName)
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+// pull policy Kubernetes defaults to for the image
+func tagPullPolicy(image string) corev1.PullPolicy {
+	if latestImage(image) {
+		return corev1.PullAlways
 	}
+	return corev1.PullIfNotPresent
+}
 
-	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}
-	patchBytes, err := createPatch(availableAnnotations, annotations, availableLabels, addLabels)
-	if err != nil {
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+// pull images referenced by the latest tag on every start, so that stale cached images are not run
+func (whsvr *WebhookServer) updateLatestImagePullPolicy(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	patch = append(patch, whsvr.pullLatestAlways(m, "/spec/initContainers", spec.InitContainers)...)
+	patch = append(patch, whsvr.pullLatestAlways(m, "/spec/containers", spec.Containers)...)
+	return patch, nil
+}
+
+func (whsvr *WebhookServer) pullLatestAlways(m *podMutation, path string, containers []corev1.Container) (patch []patchOperation) {
+	for _, i := range whsvr.mutableContainers(m, containers) {
+		container := &containers[i]
+		if !latestImage(container.Image) || container.ImagePullPolicy == corev1.PullAlways {
+			continue
+		}
+		op := "add"
+		if container.ImagePullPolicy != "" {
+			op = "replace"
 		}
+		container.ImagePullPolicy = corev1.PullAlways
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  fmt.Sprintf("%s/%d/imagePullPolicy", path, i),
+			Value: corev1.PullAlways,
+		})
 	}
+	return patch
+}
 
-	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
+// inject the configured startup probe into the targeted containers lacking one, unless the pod opts out
+func (whsvr *WebhookServer) addStartupProbe(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	startup := whsvr.config.StartupProbe
+	if startup.Probe == nil || m.optedOut(admissionWebhookAnnotationStartupKey) {
+		return patch, nil
 	}
-}
 
-// Serve method for webhook server
-func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+	for _, i := range whsvr.targetedContainers(m, spec.Containers, startup.Containers) {
+		if spec.Containers[i].StartupProbe != nil {
+			continue
 		}
+		spec.Containers[i].StartupProbe = startup.Probe.DeepCopy()
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/startupProbe", i),
+			Value: startup.Probe,
+		})
 	}
-	if len(body) == 0 {
-		glog.Error("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
-		return
+	return patch, nil
+}
+
+// set the configured preStop hook on the targeted containers
+func (whsvr *WebhookServer) updatePreStop(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	preStop := whsvr.config.PreStop
+	if preStop.Handler == nil {
+		return patch, nil
 	}
 
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
+	for _, i := range whsvr.targetedContainers(m, spec.Containers, preStop.Containers) {
+		container := spec.Containers[i]
+		path := fmt.Sprintf("/spec/containers/%d/lifecycle", i)
+		switch {
+		case container.Lifecycle == nil:
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: corev1.Lifecycle{PreStop: preStop.Handler},
+			})
+		case container.Lifecycle.PreStop == nil:
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path + "/preStop",
+				Value: preStop.Handler,
+			})
+		case whsvr.force:
+			patch = append(patch, patchOperation{
+				Op:    "replace",
+				Path:  path + "/preStop",
+				Value: preStop.Handler,
+			})
+		}
+	}
+	return patch, nil
+}
+
+// inject the configured ConfigMap volume and mount it read-only into the containers
+func (whsvr *WebhookServer) addConfigMapVolume(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	cfg := whsvr.config.ConfigMapVolume
+	if cfg.Name == "" {
+		return patch, nil
 	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
+	volume := corev1.Volume{
+		Name: cfg.Name,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cfg.ConfigMapName},
 			},
+		},
+	}
+	mount := corev1.VolumeMount{
+		Name:      cfg.Name,
+		MountPath: cfg.MountPath,
+		ReadOnly:  true,
+	}
+	if override, ok := m.pod.Annotations[admissionWebhookAnnotationMountKey]; ok {
+		if path.IsAbs(override) {
+			mount.MountPath = path.Clean(override)
+		} else {
+			m.warn("ignoring %s annotation %q, the mount path must be absolute", admissionWebhookAnnotationMountKey, override)
 		}
-	} else {
-		fmt.Println(r.URL.Path)
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar)
-		} else if r.URL.Path == "/validate" {
-			admissionResponse = whsvr.validate(&ar)
+	}
+
+	patch = append(patch, addVolume(spec, volume)...)
+	patch = append(patch, whsvr.addVolumeMount(m, mount)...)
+	return patch, nil
+}
+
+// inject the configured projected service account token volume and mount it read-only into the containers
+func (whsvr *WebhookServer) addServiceAccountTokenVolume(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	cfg := whsvr.config.ServiceAccountToken
+	if cfg.VolumeName == "" {
+		return patch, nil
+	}
+
+	projection := &corev1.ServiceAccountTokenProjection{
+		Audience: cfg.Audience,
+		Path:     cfg.Path,
+	}
+	if cfg.ExpirationSeconds > 0 {
+		projection.ExpirationSeconds = &cfg.ExpirationSeconds
+	}
+	volume := corev1.Volume{
+		Name: cfg.VolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{ServiceAccountToken: projection}},
+			},
+		},
+	}
+	mount := corev1.VolumeMount{
+		Name:      cfg.VolumeName,
+		MountPath: cfg.MountPath,
+		ReadOnly:  true,
+	}
+
+	patch = append(patch, addVolume(spec, volume)...)
+	patch = append(patch, whsvr.addVolumeMount(m, mount)...)
+	return patch, nil
+}
+
+// inject the configured volumes and mount each of them into the containers
+func (whsvr *WebhookServer) addVolumes(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	for _, cfg := range whsvr.config.Volumes {
+		mount := corev1.VolumeMount{
+			Name:      cfg.Name,
+			MountPath: cfg.MountPath,
+			SubPath:   cfg.SubPath,
+			ReadOnly:  cfg.ReadOnly,
 		}
+		patch = append(patch, addVolume(spec, cfg.Volume)...)
+		patch = append(patch, whsvr.addVolumeMount(m, mount)...)
 	}
+	return patch, nil
+}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+// append the configured sidecar containers the pod does not run yet, as native sidecars when supported
+func (whsvr *WebhookServer) addSidecars(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	images := whsvr.selectedSidecarImages(m)
+	for _, sidecar := range whsvr.config.Sidecars {
+		if hasContainer(spec.Containers, sidecar.Name) || hasContainer(spec.InitContainers, sidecar.Name) {
+			continue
+		}
+		if image, ok := images[sidecar.Name]; ok {
+			sidecar.Image = image
+		}
+		sidecar = sidecarWithFreePorts(m, sidecar)
+		if !whsvr.nativeSidecars {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/containers/-",
+				Value: sidecar,
+			})
+			spec.Containers = append(spec.Containers, sidecar)
+			continue
+		}
+
+		value, err := nativeSidecar(sidecar)
+		if err != nil {
+			return nil, err
+		}
+		if len(spec.InitContainers) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/initContainers",
+				Value: []interface{}{value},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/initContainers/-",
+				Value: value,
+			})
 		}
+		spec.InitContainers = append(spec.InitContainers, sidecar)
 	}
+	return patch, nil
+}
 
-	resp, err := json.Marshal(admissionReview)
+// the container with restartPolicy Always, which the vendored API types predate
+func nativeSidecar(container corev1.Container) (map[string]interface{}, error) {
+	raw, err := json.Marshal(container)
 	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return nil, err
 	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	var value map[string]interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	value["restartPolicy"] = "Always"
+	return value, nil
+}
+
+// Images the pod selects for its sidecars by approved name, e.g. log-shipper=fluent-bit-1.9,proxy=envoy.
+// Entries naming an unknown sidecar or image are ignored with a warning, the sidecar keeps its image.
+func (whsvr *WebhookServer) selectedSidecarImages(m *podMutation) map[string]string {
+	value, ok := m.pod.Annotations[admissionWebhookAnnotationImagesKey]
+	if !ok {
+		return nil
+	}
+	images := map[string]string{}
+	for _, selection := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(selection), "=", 2)
+		if len(parts) != 2 {
+			m.warn("ignoring %s annotation entry %q, expect <sidecar>=<image name>", admissionWebhookAnnotationImagesKey, selection)
+			continue
+		}
+		sidecar, name := parts[0], parts[1]
+		image, approved := whsvr.config.SidecarImages[name]
+		switch {
+		case !hasContainer(whsvr.config.Sidecars, sidecar):
+			m.warn("ignoring %s annotation entry %q, no sidecar %s is injected", admissionWebhookAnnotationImagesKey, selection, sidecar)
+		case !approved:
+			m.warn("ignoring %s annotation entry %q, %s is not an approved image", admissionWebhookAnnotationImagesKey, selection, name)
+		default:
+			images[sidecar] = image
+		}
+	}
+	return images
+}
+
+// The sidecar without the container ports already used in the pod, containers share the pod network
+// namespace so a second listener on the port would fail to bind.
+func sidecarWithFreePorts(m *podMutation, sidecar corev1.Container) corev1.Container {
+	if len(sidecar.Ports) == 0 {
+		return sidecar
+	}
+	used := map[corev1.ContainerPort]string{}
+	for _, container := range allContainers(&m.pod.Spec) {
+		for _, port := range container.Ports {
+			used[corev1.ContainerPort{ContainerPort: port.ContainerPort, Protocol: portProtocol(port)}] = container.Name
+		}
+	}
+
+	sidecar = *sidecar.DeepCopy()
+	ports := sidecar.Ports[:0]
+	for _, port := range sidecar.Ports {
+		if owner, ok := used[corev1.ContainerPort{ContainerPort: port.ContainerPort, Protocol: portProtocol(port)}]; ok {
+			m.warn("container %s already uses port %d/%s, skipping it on sidecar %s", owner, port.ContainerPort, portProtocol(port), sidecar.Name)
+			continue
+		}
+		ports = append(ports, port)
+	}
+	sidecar.Ports = ports
+	return sidecar
+}
+
+// protocol of the container port, TCP when unset
+func portProtocol(port corev1.ContainerPort) corev1.Protocol {
+	if port.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, container := range containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// the volume is also appended to the spec, so later mutations patch against the updated volume list
+func addVolume(spec *corev1.PodSpec, volume corev1.Volume) (patch []patchOperation) {
+	for _, existing := range spec.Volumes {
+		if existing.Name == volume.Name {
+			return patch
+		}
+	}
+
+	if len(spec.Volumes) == 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/volumes",
+			Value: []corev1.Volume{volume},
+		})
+	} else {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/volumes/-",
+			Value: volume,
+		})
+	}
+	spec.Volumes = append(spec.Volumes, volume)
+	return patch
+}
+
+// mount into the mutable app containers and, with mountInitContainers, the init containers, all
+// getting the same mount through the same deduplication
+func (whsvr *WebhookServer) addVolumeMount(m *podMutation, mount corev1.VolumeMount) (patch []patchOperation) {
+	spec := &m.pod.Spec
+	// a pod without app containers (e.g. only init containers) is rejected by the API server anyway
+	if len(spec.Containers) == 0 {
+		glog.Warningf("Pod has no containers, skipping volume mount %s", mount.Name)
+		return patch
+	}
+
+	if whsvr.config.MountInitContainers {
+		patch = append(patch, whsvr.mountContainers(m, "/spec/initContainers", spec.InitContainers, mount)...)
+	}
+	return append(patch, whsvr.mountContainers(m, "/spec/containers", spec.Containers, mount)...)
+}
+
+func (whsvr *WebhookServer) mountContainers(m *podMutation, containersPath string, containers []corev1.Container, mount corev1.VolumeMount) (patch []patchOperation) {
+	for _, i := range whsvr.mutableContainers(m, containers) {
+		if names := whsvr.config.mountContainers; names != nil && !names.MatchString(containers[i].Name) {
+			continue
+		}
+		if conflict := mountPathConflict(containers[i].VolumeMounts, mount); conflict != "" {
+			if whsvr.config.MountConflictPolicy == mountConflictSkip {
+				m.warn("container %s already mounts volume %s at %s, skipping volume %s", containers[i].Name, conflict, mount.MountPath, mount.Name)
+				continue
+			}
+			m.warn("container %s already mounts volume %s at %s, mounting volume %s there makes the pod invalid", containers[i].Name, conflict, mount.MountPath, mount.Name)
+		}
+		mountsPath := fmt.Sprintf("%s/%d/volumeMounts", containersPath, i)
+		patch = append(patch, appendVolumeMountIfMissing(mountsPath, &containers[i].VolumeMounts, mount)...)
+	}
+	return patch
+}
+
+// name of another volume, or of the same volume at another subPath, already mounted at the mount path, or ""
+func mountPathConflict(target []corev1.VolumeMount, mount corev1.VolumeMount) string {
+	for _, existing := range target {
+		if !sameVolumeMount(existing, mount) && path.Clean(existing.MountPath) == path.Clean(mount.MountPath) {
+			return existing.Name
+		}
+	}
+	return ""
+}
+
+// the mount is also appended to target, so later mutations patch against the updated mount list
+func appendVolumeMountIfMissing(path string, target *[]corev1.VolumeMount, mount corev1.VolumeMount) (patch []patchOperation) {
+	for _, existing := range *target {
+		if sameVolumeMount(existing, mount) {
+			return patch
+		}
+	}
+
+	if len(*target) == 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: []corev1.VolumeMount{mount},
+		})
+	} else {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path + "/-",
+			Value: mount,
+		})
+	}
+	*target = append(*target, mount)
+	return patch
+}
+
+// whether both mount the same path of the same volume at the same place, the readOnly flag of
+// an existing mount is kept as is
+func sameVolumeMount(existing, mount corev1.VolumeMount) bool {
+	return existing.Name == mount.Name && path.Clean(existing.SubPath) == path.Clean(mount.SubPath) &&
+		path.Clean(existing.MountPath) == path.Clean(mount.MountPath)
+}
+
+// state of a single pod mutation shared by the patch builders, which run in order and keep
+// the pod in sync with the operations they emit so that later patch paths stay valid
+type podMutation struct {
+	pod       *corev1.Pod
+	namespace string
+	uid       types.UID // of the admission request
+	warnings  []string  // returned to the client as admission warnings
+	profile   []string  // mutations of the selected profile, every enabled one when nil
+	log       requestLog
+}
+
+// whether the pod disables a mutation by setting its annotation to a false value
+func (m *podMutation) optedOut(annotationKey string) bool {
+	switch strings.ToLower(m.pod.Annotations[annotationKey]) {
+	case "n", "no", "false", "off":
+		return true
+	}
+	return false
+}
+
+func (m *podMutation) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	glog.Warning(warning)
+	m.warnings = append(m.warnings, warning)
+}
+
+// merge the configured topology spread constraints, unless the pod opts out via annotation
+func (whsvr *WebhookServer) addTopologySpreadConstraints(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	if len(whsvr.config.TopologySpreadConstraints) == 0 || m.optedOut(admissionWebhookAnnotationTopologyKey) {
+		return patch, nil
+	}
+
+	existing := map[string]bool{}
+	for _, constraint := range spec.TopologySpreadConstraints {
+		existing[constraint.TopologyKey+"/"+string(constraint.WhenUnsatisfiable)] = true
+	}
+
+	var added []corev1.TopologySpreadConstraint
+	for _, constraint := range whsvr.config.TopologySpreadConstraints {
+		if !existing[constraint.TopologyKey+"/"+string(constraint.WhenUnsatisfiable)] {
+			added = append(added, constraint)
+		}
+	}
+	if len(added) == 0 {
+		return patch, nil
+	}
+
+	if len(spec.TopologySpreadConstraints) == 0 {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/topologySpreadConstraints",
+			Value: added,
+		}), nil
+	}
+	for _, constraint := range added {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/topologySpreadConstraints/-",
+			Value: constraint,
+		})
+	}
+	return patch, nil
+}
+
+// add the configured envFrom sources missing from the targeted containers
+func (whsvr *WebhookServer) addEnvFrom(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	envFrom := whsvr.config.EnvFrom
+	if len(envFrom.Sources) == 0 || m.optedOut(admissionWebhookAnnotationEnvFromKey) {
+		return patch, nil
+	}
+
+	for _, i := range whsvr.targetedContainers(m, spec.Containers, envFrom.Containers) {
+		var added []corev1.EnvFromSource
+		for _, source := range envFrom.Sources {
+			if !hasEnvFromSource(spec.Containers[i].EnvFrom, source) {
+				added = append(added, source)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+
+		path := fmt.Sprintf("/spec/containers/%d/envFrom", i)
+		if len(spec.Containers[i].EnvFrom) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: added,
+			})
+			continue
+		}
+		for _, source := range added {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path + "/-",
+				Value: source,
+			})
+		}
+	}
+	return patch, nil
+}
+
+// set GOMAXPROCS to the CPU limit of the targeted containers limited to whole cores, unless they set it
+// already. Containers without a CPU limit or with a fractional one are skipped.
+func (whsvr *WebhookServer) addGoMaxProcs(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	for _, i := range whsvr.targetedContainers(m, spec.Containers, whsvr.config.GoMaxProcs.Containers) {
+		container := &spec.Containers[i]
+		limit, ok := container.Resources.Limits[corev1.ResourceCPU]
+		if !ok || limit.MilliValue() <= 0 || limit.MilliValue()%1000 != 0 || hasEnvVar(container.Env, "GOMAXPROCS") {
+			continue
+		}
+
+		env := corev1.EnvVar{Name: "GOMAXPROCS", Value: strconv.FormatInt(limit.MilliValue()/1000, 10)}
+		path := fmt.Sprintf("/spec/containers/%d/env", i)
+		if len(container.Env) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: []corev1.EnvVar{env},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path + "/-",
+				Value: env,
+			})
+		}
+		container.Env = append(container.Env, env)
+	}
+	return patch, nil
+}
+
+func hasEnvVar(env []corev1.EnvVar, name string) bool {
+	for _, existing := range env {
+		if existing.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// merge the configured resource defaults into the targeted containers, requests and limits they
+// already declare (e.g. cpu and memory) are kept
+func (whsvr *WebhookServer) addResourceDefaults(m *podMutation) (patch []patchOperation, err error) {
+	spec := &m.pod.Spec
+	defaults := whsvr.config.ResourceDefaults
+	if (len(defaults.Requests) == 0 && len(defaults.Limits) == 0) || m.optedOut(admissionWebhookAnnotationResourceKey) {
+		return patch, nil
+	}
+
+	for _, i := range whsvr.targetedContainers(m, spec.Containers, defaults.Containers) {
+		resources := &spec.Containers[i].Resources
+		path := fmt.Sprintf("/spec/containers/%d/resources", i)
+		patch = append(patch, mergeResourceList(path+"/requests", &resources.Requests, defaults.Requests)...)
+
+		// a default limit below the container's own request would make the pod invalid
+		limits := corev1.ResourceList{}
+		for name, limit := range defaults.Limits {
+			if _, ok := resources.Limits[name]; ok {
+				continue
+			}
+			if request, ok := resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+				m.warn("Container %s requests more %s than the default limit %s, the limit is not set", spec.Containers[i].Name, name, limit.String())
+				continue
+			}
+			limits[name] = limit
+		}
+		patch = append(patch, mergeResourceList(path+"/limits", &resources.Limits, limits)...)
+	}
+	return patch, nil
+}
+
+// add the defaults missing from target, in resource name order
+func mergeResourceList(path string, target *corev1.ResourceList, defaults corev1.ResourceList) (patch []patchOperation) {
+	var names []string
+	for name := range defaults {
+		if _, ok := (*target)[name]; !ok {
+			names = append(names, string(name))
+		}
+	}
+	if len(names) == 0 {
+		return patch
+	}
+	sort.Strings(names)
+
+	if *target == nil {
+		*target = corev1.ResourceList{}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: corev1.ResourceList{},
+		})
+	}
+	for _, name := range names {
+		quantity := defaults[corev1.ResourceName(name)]
+		(*target)[corev1.ResourceName(name)] = quantity
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path + "/" + jsonPointerEscape(name),
+			Value: quantity.String(),
+		})
+	}
+	return patch
+}
+
+func hasEnvFromSource(target []corev1.EnvFromSource, source corev1.EnvFromSource) bool {
+	for _, existing := range target {
+		if existing.Prefix != source.Prefix {
+			continue
+		}
+		if existing.ConfigMapRef != nil && source.ConfigMapRef != nil && existing.ConfigMapRef.Name == source.ConfigMapRef.Name {
+			return true
+		}
+		if existing.SecretRef != nil && source.SecretRef != nil && existing.SecretRef.Name == source.SecretRef.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// a patch builder returns the JSON patch for one pod mutation
+type patchBuilder struct {
+	name    string
+	enabled bool     // configured, disabled builders are not run
+	after   []string // builders which must run first, whether enabled or not
+	build   func(m *podMutation) ([]patchOperation, error)
+}
+
+func (whsvr *WebhookServer) podPatchBuilders() []patchBuilder {
+	cfg := whsvr.config
+	return []patchBuilder{
+		{name: "pod-labels", enabled: len(cfg.PodLabels) > 0, build: whsvr.addPodLabels},
+		{name: "priority-class-name", enabled: cfg.PriorityClassName != "", build: whsvr.updatePriorityClassName},
+		{name: "runtime-class-name", enabled: cfg.RuntimeClass.Name != "", build: whsvr.updateRuntimeClassName},
+		{name: "dns", enabled: cfg.DNS.Policy != "" || cfg.DNS.Config != nil, build: whsvr.updateDNS},
+		{name: "zone-affinity", enabled: len(cfg.ZoneAffinity.Zones) > 0, build: whsvr.addZoneAffinity},
+		{name: "tolerations", enabled: len(cfg.Tolerations) > 0, build: whsvr.addTolerations},
+		{name: "termination-grace-period", enabled: cfg.TerminationGracePeriodSeconds != nil || cfg.MinTerminationGracePeriodSeconds != nil, build: whsvr.updateTerminationGracePeriod},
+		{name: "fs-group", enabled: cfg.FSGroup != nil, build: whsvr.updateFSGroup},
+		{name: "image-pull-policy", enabled: cfg.ImagePullPolicy != "", build: whsvr.updateImagePullPolicy},
+		{name: "latest-image-pull-policy", enabled: cfg.LatestImageTag.PullAlways, build: whsvr.updateLatestImagePullPolicy},
+		{name: "pre-stop", enabled: cfg.PreStop.Handler != nil, build: whsvr.updatePreStop},
+		{name: "startup-probe", enabled: cfg.StartupProbe.Probe != nil, build: whsvr.addStartupProbe},
+		{name: "configmap-volume", enabled: cfg.ConfigMapVolume.Name != "", build: whsvr.addConfigMapVolume},
+		{name: "service-account-token-volume", enabled: cfg.ServiceAccountToken.VolumeName != "", build: whsvr.addServiceAccountTokenVolume},
+		{name: "volumes", enabled: len(cfg.Volumes) > 0, build: whsvr.addVolumes},
+		{name: "topology-spread-constraints", enabled: len(cfg.TopologySpreadConstraints) > 0, build: whsvr.addTopologySpreadConstraints},
+		{name: "env-from", enabled: len(cfg.EnvFrom.Sources) > 0, build: whsvr.addEnvFrom},
+		{name: "resource-defaults", enabled: len(cfg.ResourceDefaults.Requests) > 0 || len(cfg.ResourceDefaults.Limits) > 0, build: whsvr.addResourceDefaults},
+		// resource defaults may set the CPU limit
+		{name: "gomaxprocs", enabled: cfg.GoMaxProcs.Enabled, build: whsvr.addGoMaxProcs, after: []string{"resource-defaults"}},
+		// the sidecars come with their own settings and must not pick up the app container mutations
+		{name: "sidecars", enabled: len(cfg.Sidecars) > 0, build: whsvr.addSidecars, after: []string{
+			"image-pull-policy", "latest-image-pull-policy", "pre-stop", "startup-probe", "configmap-volume", "service-account-token-volume",
+			"volumes", "env-from", "resource-defaults", "gomaxprocs",
+		}},
+	}
+}
+
+// Order the pod mutations, the configured pipeline steps first, while running every builder after its
+// dependencies. Fails on unknown or duplicate steps and on dependency cycles.
+func (whsvr *WebhookServer) checkPipeline() error {
+	builders := whsvr.podPatchBuilders()
+	rank := map[string]int{}
+	for _, builder := range builders {
+		rank[builder.name] = len(whsvr.config.MutationPipeline) + len(rank)
+	}
+	after := map[string][]string{}
+	for _, builder := range builders {
+		after[builder.name] = builder.after
+	}
+	for i, step := range whsvr.config.MutationPipeline {
+		if _, ok := rank[step.Name]; !ok {
+			return fmt.Errorf("mutationPipeline: unknown mutation %s", step.Name)
+		}
+		if rank[step.Name] < len(whsvr.config.MutationPipeline) {
+			return fmt.Errorf("mutationPipeline: duplicate mutation %s", step.Name)
+		}
+		for _, dependency := range step.After {
+			if _, ok := rank[dependency]; !ok {
+				return fmt.Errorf("mutationPipeline: %s runs after unknown mutation %s", step.Name, dependency)
+			}
+		}
+		rank[step.Name] = i
+		after[step.Name] = append(after[step.Name], step.After...)
+	}
+
+	// repeatedly run the best ranked builder whose dependencies have all run
+	done := map[string]bool{}
+	pipeline := make([]patchBuilder, 0, len(builders))
+	for len(pipeline) < len(builders) {
+		next := -1
+		for i, builder := range builders {
+			if done[builder.name] || (next >= 0 && rank[builder.name] > rank[builders[next].name]) {
+				continue
+			}
+			ready := true
+			for _, dependency := range after[builder.name] {
+				ready = ready && done[dependency]
+			}
+			if ready {
+				next = i
+			}
+		}
+		if next < 0 {
+			var cycle []string
+			for _, builder := range builders {
+				if !done[builder.name] {
+					cycle = append(cycle, builder.name)
+				}
+			}
+			return fmt.Errorf("mutationPipeline: dependency cycle among %s", strings.Join(cycle, ", "))
+		}
+		done[builders[next].name] = true
+		pipeline = append(pipeline, builders[next])
+	}
+	whsvr.pipeline = pipeline
+	return nil
+}
+
+// whether the request falls in the canary, hashing its UID keeps the decision deterministic
+func canarySelected(uid types.UID, percent int) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(uid))
+	return int(hash.Sum32()%100) < percent
+}
+
+// error naming the first canary mutation which does not match a pod mutation
+func (whsvr *WebhookServer) checkCanary() error {
+	names := map[string]bool{}
+	for _, builder := range whsvr.podPatchBuilders() {
+		names[builder.name] = true
+	}
+	for _, name := range whsvr.config.Canary.Mutations {
+		if !names[name] {
+			return fmt.Errorf("canary: unknown mutation %s", name)
+		}
+	}
+	return nil
+}
+
+func (whsvr *WebhookServer) checkProfiles() error {
+	names := map[string]bool{}
+	for _, builder := range whsvr.podPatchBuilders() {
+		names[builder.name] = true
+	}
+	for profile, mutations := range whsvr.config.Profiles {
+		for _, name := range mutations {
+			if !names[name] {
+				return fmt.Errorf("profile %s: unknown mutation %s", profile, name)
+			}
+		}
+	}
+	return nil
+}
+
+// mutations of the profile named by the request header, nil runs every enabled mutation.
+// An unknown name is ignored with a warning.
+func (whsvr *WebhookServer) selectProfile(name string, uid types.UID) []string {
+	if name == "" {
+		return nil
+	}
+	mutations, ok := whsvr.config.Profiles[name]
+	if !ok {
+		glog.Warningf("Ignoring unknown profile %q requested by %v", name, uid)
+		return nil
+	}
+	// an empty profile selects no mutation rather than every one
+	if mutations == nil {
+		mutations = []string{}
+	}
+	return mutations
+}
+
+// names of the pod mutations enabled by the configuration
+func (whsvr *WebhookServer) enabledMutations() []string {
+	mutations := []string{}
+	for _, builder := range whsvr.pipeline {
+		if builder.enabled {
+			mutations = append(mutations, builder.name)
+		}
+	}
+	return mutations
+}
+
+// mutation is only set for pods, deployments and services get the missing labels. No patch is
+// returned when there is nothing to change.
+func (whsvr *WebhookServer) createPatch(kind string, mutation *podMutation, availableAnnotations map[string]string, annotations map[string]string, availableLabels map[string]string, labels map[string]string) ([]byte, error) {
+	var patch []patchOperation
+
+	switch {
+	case mutation != nil:
+		for _, builder := range whsvr.pipeline {
+			if !builder.enabled || (mutation.profile != nil && !contains(mutation.profile, builder.name)) {
+				continue
+			}
+			if contains(whsvr.config.Canary.Mutations, builder.name) && !canarySelected(mutation.uid, whsvr.config.Canary.Percent) {
+				mutation.log.Infof("Request %v is outside the canary of mutation %s", mutation.uid, builder.name)
+				continue
+			}
+			// later builders compute their paths against the pod, so a skipped builder must leave it unchanged
+			var pod *corev1.Pod
+			if whsvr.config.FailurePolicy != admissionregistrationv1beta1.Fail {
+				pod = mutation.pod.DeepCopy()
+			}
+			ops, err := builder.build(mutation)
+			if err != nil {
+				glog.Errorf("Mutation %s failed: %v", builder.name, err)
+				if whsvr.config.FailurePolicy == admissionregistrationv1beta1.Fail {
+					return nil, fmt.Errorf("mutation %s failed: %v", builder.name, err)
+				}
+				*mutation.pod = *pod
+				continue
+			}
+			patch = append(patch, ops...)
+		}
+	case kind == "Deployment" || kind == "Service":
+		patch = append(patch, updateLabels(availableLabels, labels)...)
+	}
+	patch = append(patch, whsvr.config.genericPatches(kind)...)
+	// the status annotations only record applied mutations, an object nothing applies to is admitted without a patch
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	patch = append(updateAnnotation(availableAnnotations, annotations), patch...)
+
+	// guard against pathological objects, e.g. pods with thousands of containers, producing huge responses
+	if limit := whsvr.config.MaxPatchOperations; limit > 0 && len(patch) > limit {
+		err := fmt.Errorf("patch of %d operations exceeds maxPatchOperations %d", len(patch), limit)
+		if whsvr.config.FailurePolicy == admissionregistrationv1beta1.Fail {
+			return nil, err
+		}
+		glog.Errorf("%v, the object is admitted unmutated", err)
+		patch = nil
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	observePatch(patch, patchBytes)
+	return patchBytes, nil
+}
+
+// validate deployments and services
+func (whsvr *WebhookServer) validate(ar *v1beta1.AdmissionReview, log requestLog) *v1beta1.AdmissionResponse {
+	req := ar.Request
+	if subResource := requestedSubResource(req); subResource != "" {
+		log.Infof("Skipping validation for %s/%s: subresource %s", req.Namespace, req.Name, subResource)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	var (
+		availableLabels                 map[string]string
+		objectMeta                      *metav1.ObjectMeta
+		pod                             *corev1.Pod
+		resourceNamespace, resourceName string
+	)
+
+	switch req.Kind.Kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
+		availableLabels = deployment.Labels
+	case "Service":
+		var service corev1.Service
+		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
+		availableLabels = service.Labels
+	case "Pod":
+		pod = &corev1.Pod{}
+		if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = pod.Name, pod.Namespace, &pod.ObjectMeta
+	}
+
+	if !validationRequired(ignoredNamespaces, objectMeta, log) {
+		log.Infof("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// pods are checked against the configured pod policy, not the required labels
+	if pod != nil {
+		return whsvr.validatePod(req.Namespace, &pod.ObjectMeta, &pod.Spec, log)
+	}
+
+	allowed := true
+	var result *metav1.Status
+	decision := map[string]string{"allowed": "true"}
+	log.Infof("available labels: %v", availableLabels)
+	log.Infof("required labels: %v", requiredLabels)
+	for _, rl := range requiredLabels {
+		if _, ok := availableLabels[rl]; !ok {
+			allowed = false
+			result = deniedError("required labels are not set").status()
+			decision = map[string]string{"allowed": "false", "rule": "required-labels"}
+			break
+		}
+	}
+
+	return &v1beta1.AdmissionResponse{
+		Allowed:          allowed,
+		Result:           result,
+		AuditAnnotations: whsvr.auditAnnotations(decision),
+	}
+}
+
+// audit annotations recorded for an admission decision, nil unless enabled in the configuration
+func (whsvr *WebhookServer) auditAnnotations(decision map[string]string) map[string]string {
+	audit := whsvr.config.AuditAnnotations
+	if !audit.Enabled {
+		return nil
+	}
+
+	annotations := map[string]string{}
+	for key, value := range audit.Extra {
+		annotations[key] = value
+	}
+	for key, value := range decision {
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// a pod policy rule returns the reason for denying the pod, or "" when it complies
+type podRule struct {
+	name  string
+	check func(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string
+	warn  bool // admit violating pods with a warning instead of denying them
+}
+
+func (whsvr *WebhookServer) podRules() []podRule {
+	return []podRule{
+		{name: "default-service-account", check: whsvr.checkDefaultServiceAccount},
+		{name: "max-containers", check: whsvr.checkMaxContainers},
+		{name: "denied-capabilities", check: whsvr.checkCapabilities},
+		{name: "denied-env-vars", check: whsvr.checkEnvVars},
+		{name: "host-namespaces", check: whsvr.checkHostNamespaces},
+		{name: "privileged-containers", check: whsvr.checkPrivilegedContainers},
+		{name: "latest-image-tag", check: whsvr.checkLatestImageTag, warn: whsvr.config.LatestImageTag.Action == ruleActionWarn},
+		{name: "probes", check: whsvr.checkProbes, warn: whsvr.config.Probes.Action == ruleActionWarn},
+		{name: "image-size-attestation", check: whsvr.checkImageSizeAttestation},
+		{name: "annotation-formats", check: whsvr.checkAnnotationFormats},
+	}
+}
+
+// whether violations of the rule are admitted with a warning, by its configured mode or else its own action
+func (whsvr *WebhookServer) audited(rule podRule) bool {
+	switch whsvr.config.RuleModes[rule.name] {
+	case ruleModeAudit:
+		return true
+	case ruleModeEnforce:
+		return false
+	}
+	return rule.warn
+}
+
+// error naming the first configured rule mode which does not match a pod rule
+func (whsvr *WebhookServer) checkRuleModes() error {
+	names := map[string]bool{}
+	for _, rule := range whsvr.podRules() {
+		names[rule.name] = true
+	}
+	for name := range whsvr.config.RuleModes {
+		if !names[name] {
+			return fmt.Errorf("ruleModes: unknown rule %s", name)
+		}
+	}
+	return nil
+}
+
+// validate pod specs against the configured policy rules
+func (whsvr *WebhookServer) validatePod(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec, log requestLog) *v1beta1.AdmissionResponse {
+	var rules, reasons, warnings []string
+	for _, rule := range whsvr.podRules() {
+		reason := rule.check(namespace, meta, spec)
+		switch {
+		case reason == "":
+		case whsvr.audited(rule):
+			warnings = append(warnings, reason)
+		default:
+			rules = append(rules, rule.name)
+			reasons = append(reasons, whsvr.denyMessage(rule.name, reason, namespace))
+			validationDenials.WithLabelValues(rule.name).Inc()
+		}
+	}
+
+	if len(reasons) > 0 {
+		log.Infof("Denying pod in namespace %s: %v", namespace, reasons)
+		response := deniedError(strings.Join(reasons, "; ")).toAdmissionResponse()
+		response.Warnings = warnings
+		response.AuditAnnotations = whsvr.auditAnnotations(map[string]string{"allowed": "false", "rule": strings.Join(rules, ",")})
+		return response
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed:          true,
+		Warnings:         warnings,
+		AuditAnnotations: whsvr.auditAnnotations(map[string]string{"allowed": "true"}),
+	}
+}
+
+// fields available to the deny message template
+type denial struct {
+	Rule      string
+	Reason    string
+	Namespace string
+}
+
+// the denial rendered with the configured template, the plain reason without one
+func (whsvr *WebhookServer) denyMessage(rule, reason, namespace string) string {
+	tmpl := whsvr.config.denyMessage
+	if tmpl == nil {
+		return reason
+	}
+	var message strings.Builder
+	if err := tmpl.Execute(&message, denial{Rule: rule, Reason: reason, Namespace: namespace}); err != nil {
+		glog.Errorf("Can't render the deny message of rule %s: %v", rule, err)
+		return reason
+	}
+	return message.String()
+}
+
+// deny pods which don't name a service account explicitly
+func (whsvr *WebhookServer) checkDefaultServiceAccount(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.DefaultServiceAccount
+	if !rule.Enabled || rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+	if spec.ServiceAccountName != "" && spec.ServiceAccountName != "default" {
+		return ""
+	}
+	if (len(rule.Namespaces) == 0 && rule.namespaceSelector == nil) || contains(rule.Namespaces, namespace) {
+		return "pods must set an explicit serviceAccountName other than \"default\""
+	}
+	if rule.namespaceSelector == nil {
+		return ""
+	}
+	ns, err := whsvr.getNamespace(namespace)
+	if err != nil {
+		// fail closed, the namespace may be enforced
+		glog.Errorf("Can't get namespace %s: %v", namespace, err)
+	} else if !rule.namespaceSelector.Matches(labels.Set(ns.Labels)) {
+		return ""
+	}
+	return fmt.Sprintf("pods in namespaces matching %s must run as a dedicated service account rather than \"default\", "+
+		"which every workload of the namespace shares", rule.namespaceSelector)
+}
+
+// deny runaway pods declaring more containers than the configured limit
+func (whsvr *WebhookServer) checkMaxContainers(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	limit := whsvr.config.MaxContainers
+	if limit <= 0 {
+		return ""
+	}
+	if count := len(spec.Containers) + len(spec.InitContainers); count > limit {
+		return fmt.Sprintf("pod declares %d containers, at most %d are allowed", count, limit)
+	}
+	return ""
+}
+
+// deny app and init containers adding any of the configured capabilities
+func (whsvr *WebhookServer) checkCapabilities(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	denied := map[string]bool{}
+	for _, capability := range whsvr.config.DeniedCapabilities {
+		denied[normalizeCapability(capability)] = true
+	}
+	if len(denied) == 0 {
+		return ""
+	}
+
+	var offenders []string
+	for _, container := range allContainers(spec) {
+		if container.SecurityContext == nil || container.SecurityContext.Capabilities == nil {
+			continue
+		}
+		for _, capability := range container.SecurityContext.Capabilities.Add {
+			if denied[normalizeCapability(string(capability))] {
+				offenders = append(offenders, fmt.Sprintf("%s adds %s", container.Name, capability))
+			}
+		}
+	}
+	if len(offenders) > 0 {
+		return "containers add denied capabilities: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny app and init containers setting env vars whose name matches a denied pattern
+func (whsvr *WebhookServer) checkEnvVars(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	patterns := whsvr.config.DeniedEnvVars
+	if len(patterns) == 0 {
+		return ""
+	}
+
+	var offenders []string
+	for _, container := range allContainers(spec) {
+		for _, env := range container.Env {
+			for _, pattern := range patterns {
+				// patterns are checked in validate(), a bad one never matches
+				if matched, _ := path.Match(pattern, env.Name); matched {
+					offenders = append(offenders, fmt.Sprintf("%s sets %s", container.Name, env.Name))
+					break
+				}
+			}
+		}
+	}
+	if len(offenders) > 0 {
+		return "containers set denied env vars: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny pods with annotation values not matching the format configured for their key
+func (whsvr *WebhookServer) checkAnnotationFormats(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	var offenders []string
+	for key, format := range whsvr.config.annotationFormats {
+		if value, ok := meta.Annotations[key]; ok && !format.MatchString(value) {
+			offenders = append(offenders, fmt.Sprintf("%s=%q must match %s", key, value, whsvr.config.AnnotationFormats[key]))
+		}
+	}
+	if len(offenders) > 0 {
+		sort.Strings(offenders)
+		return "malformed annotations: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny pods sharing the host namespaces which are disabled in the configuration
+func (whsvr *WebhookServer) checkHostNamespaces(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.HostNamespaces
+	if rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+
+	var shared []string
+	if rule.DenyHostNetwork && spec.HostNetwork {
+		shared = append(shared, "hostNetwork")
+	}
+	if rule.DenyHostPID && spec.HostPID {
+		shared = append(shared, "hostPID")
+	}
+	if rule.DenyHostIPC && spec.HostIPC {
+		shared = append(shared, "hostIPC")
+	}
+	if len(shared) > 0 {
+		return "pods may not set " + strings.Join(shared, ", ")
+	}
+	return ""
+}
+
+// deny pods running privileged app or init containers
+func (whsvr *WebhookServer) checkPrivilegedContainers(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.PrivilegedContainers
+	if !rule.Enabled || rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+
+	var offenders []string
+	for _, container := range allContainers(spec) {
+		if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+			offenders = append(offenders, container.Name)
+		}
+	}
+	if len(offenders) > 0 {
+		return "containers may not run privileged: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny (or warn about) containers running an image by the latest tag or without any tag
+func (whsvr *WebhookServer) checkLatestImageTag(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.LatestImageTag
+	if !rule.Enabled || rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+
+	var offenders []string
+	for _, container := range allContainers(spec) {
+		if latestImage(container.Image) {
+			offenders = append(offenders, fmt.Sprintf("%s (%s)", container.Name, container.Image))
+		}
+	}
+	if len(offenders) > 0 {
+		return "containers must use an image pinned to a tag other than latest or to a digest: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny (or warn about) app containers declaring neither a liveness nor a readiness probe
+func (whsvr *WebhookServer) checkProbes(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.Probes
+	if !rule.Enabled || rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+
+	var offenders []string
+	for _, container := range spec.Containers {
+		if contains(rule.ExemptContainers, container.Name) {
+			continue
+		}
+		if container.LivenessProbe == nil && container.ReadinessProbe == nil {
+			offenders = append(offenders, container.Name)
+		}
+	}
+	if len(offenders) > 0 {
+		return "containers must declare a liveness or readiness probe: " + strings.Join(offenders, ", ")
+	}
+	return ""
+}
+
+// deny pods without the annotation a CI pipeline sets to attest that their images comply with the size policy
+func (whsvr *WebhookServer) checkImageSizeAttestation(namespace string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) string {
+	rule := whsvr.config.ImageSizeAttestation
+	if rule.AnnotationKey == "" || rule.Exemptions.exempt(namespace, spec.ServiceAccountName) {
+		return ""
+	}
+	if meta.Annotations[rule.AnnotationKey] != "true" {
+		return fmt.Sprintf("pods must carry the %s=true annotation attesting image size compliance", rule.AnnotationKey)
+	}
+	return ""
+}
+
+// tag of an image reference, digest is set for references pinned by digest
+func imageTag(image string) (tag string, digest bool) {
+	if strings.Contains(image, "@") {
+		return "", true
+	}
+	// a colon before the last slash belongs to the registry host:port
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:], false
+	}
+	return "", false
+}
+
+// whether the image is referenced by the latest tag or without any tag
+func latestImage(image string) bool {
+	tag, digest := imageTag(image)
+	return !digest && (tag == "" || tag == "latest")
+}
+
+// init and app containers of the pod
+func allContainers(spec *corev1.PodSpec) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(spec.InitContainers)+len(spec.Containers))
+	containers = append(containers, spec.InitContainers...)
+	return append(containers, spec.Containers...)
+}
+
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+// main mutation process
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1beta1.AdmissionReview, profile string, log requestLog) *v1beta1.AdmissionResponse {
+	req := ar.Request
+	if whsvr.killSwitch != nil && whsvr.killSwitch.on() {
+		glog.Warningf("Kill switch on, admitting %v unmutated", req.UID)
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+	// e.g. pods/status carries a whole Pod, which must not be mutated like a created one
+	if subResource := requestedSubResource(req); subResource != "" {
+		log.Infof("Skipping mutation for %s/%s: subresource %s", req.Namespace, req.Name, subResource)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	if whsvr.responseDelay > 0 {
+		glog.Warningf("Delaying the response to %v by %v", req.UID, whsvr.responseDelay)
+		// the API server gives up on the request after the webhook timeoutSeconds
+		timer := time.NewTimer(whsvr.responseDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			glog.Warningf("Request %v cancelled while delaying the response: %v", req.UID, ctx.Err())
+			return internalError(ctx.Err()).toAdmissionResponse()
+		}
+	}
+	var (
+		availableLabels, availableAnnotations map[string]string
+		objectMeta                            *metav1.ObjectMeta
+		pod                                   *corev1.Pod
+		resourceNamespace, resourceName       string
+	)
+
+	switch req.Kind.Kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
+		availableLabels, availableAnnotations = deployment.Labels, deployment.Annotations
+	case "Service":
+		var service corev1.Service
+		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
+		availableLabels, availableAnnotations = service.Labels, service.Annotations
+	case "Pod":
+		pod = &corev1.Pod{}
+		if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace, objectMeta = pod.Name, pod.Namespace, &pod.ObjectMeta
+		availableLabels, availableAnnotations = pod.Labels, pod.Annotations
+	default:
+		// any other kind only receives the generic patches configured for it
+		if len(whsvr.config.genericPatches(req.Kind.Kind)) == 0 {
+			log.Infof("No mutation configured for kind %s", req.Kind.Kind)
+			return &v1beta1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		var object unstructured.Unstructured
+		if err := object.UnmarshalJSON(req.Object.Raw); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return badRequestError(err).toAdmissionResponse()
+		}
+		resourceName, resourceNamespace = object.GetName(), object.GetNamespace()
+		objectMeta = &metav1.ObjectMeta{Name: resourceName, Namespace: resourceNamespace, Annotations: object.GetAnnotations()}
+		availableAnnotations = object.GetAnnotations()
+	}
+
+	if !whsvr.config.mutatedOperation(req.Operation) {
+		log.Infof("Skipping mutation for %s/%s: operation %s not in mutateOperations", req.Namespace, req.Name, req.Operation)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	if !whsvr.config.mutatedNamespace(req.Namespace) {
+		log.Infof("Skipping mutation for %s/%s: namespace not in includeNamespaces", req.Namespace, resourceName)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	if !mutationRequired(ignoredNamespaces, objectMeta, log) {
+		log.Infof("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	if pod != nil && !whsvr.podSelector.Matches(labels.Set(pod.Labels)) {
+		log.Infof("Skipping mutation for %s/%s: labels do not match %s", req.Namespace, resourceName, whsvr.podSelector)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	if pod != nil {
+		terminating, err := whsvr.namespaceTerminating(req.Namespace)
+		if err != nil {
+			glog.Errorf("Namespace lookup for %s/%s failed: %v", resourceNamespace, resourceName, err)
+			return whsvr.lookupFailed(err)
+		}
+		if terminating {
+			glog.Warningf("Skipping mutation for %s/%s: namespace is terminating", req.Namespace, resourceName)
+			return &v1beta1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{fmt.Sprintf("namespace %s is terminating, the pod is not mutated", req.Namespace)},
+			}
+		}
+	}
+
+	var mutation *podMutation
+	if pod != nil {
+		mutation = &podMutation{pod: pod, namespace: req.Namespace, uid: req.UID, profile: whsvr.selectProfile(profile, req.UID), log: log}
+		message, err := whsvr.checkRequiredSecret(req.Namespace)
+		if err != nil {
+			glog.Errorf("Required secret lookup for %s/%s failed: %v", resourceNamespace, resourceName, err)
+			return whsvr.lookupFailed(err)
+		}
+		if message != "" {
+			if whsvr.config.RequiredSecret.Action == ruleActionDeny {
+				return deniedError(message).toAdmissionResponse()
+			}
+			glog.Warningf("Skipping mutation for %s/%s: %s", resourceNamespace, resourceName, message)
+			return &v1beta1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{message + ", the pod is not mutated"},
+			}
+		}
+	}
+
+	annotations := map[string]string{
+		admissionWebhookAnnotationStatusKey:  "mutated",
+		admissionWebhookAnnotationVersionKey: version,
+	}
+	// lets operators find objects mutated under an older configuration
+	if whsvr.config.checksum != "" {
+		annotations[admissionWebhookAnnotationConfigKey] = whsvr.config.checksum
+	}
+	var patchBytes []byte
+	var err error
+	whsvr.patchPool.do(func() {
+		patchBytes, err = whsvr.createPatch(req.Kind.Kind, mutation, availableAnnotations, annotations, availableLabels, addLabels)
+	})
+	if err != nil {
+		return internalError(err).toAdmissionResponse()
+	}
+
+	var warnings []string
+	if mutation != nil {
+		warnings = mutation.warnings
+	}
+
+	// a no-op response carries neither patch nor patchType
+	if patchBytes == nil {
+		log.Infof("AdmissionResponse: no patch")
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings,
+		}
+	}
+	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	return &v1beta1.AdmissionResponse{
+		Allowed:          true,
+		Warnings:         warnings,
+		AuditAnnotations: whsvr.auditAnnotations(map[string]string{"mutated": "true"}),
+		Patch:            patchBytes,
+		PatchType:        jsonPatchType(),
+	}
+}
+
+func jsonPatchType() *v1beta1.PatchType {
+	pt := v1beta1.PatchTypeJSONPatch
+	return &pt
+}
+
+// mutate, admitting requests unmutated while the circuit breaker is open
+func (whsvr *WebhookServer) breakerMutate(ctx context.Context, ar *v1beta1.AdmissionReview, profile string, log requestLog) *v1beta1.AdmissionResponse {
+	if whsvr.breaker == nil {
+		return whsvr.mutate(ctx, ar, profile, log)
+	}
+	if !whsvr.breaker.allow() {
+		glog.Errorf("Circuit breaker open, admitting %v unmutated", ar.Request.UID)
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"admission webhook circuit breaker open, the object is not mutated"},
+		}
+	}
+	resp := whsvr.mutate(ctx, ar, profile, log)
+	switch {
+	case ctx.Err() != nil:
+		// the caller gave up, e.g. the API server timed out on a delayed response, which says nothing
+		// about the health of the webhook
+	case resp.Result != nil && resp.Result.Code == http.StatusInternalServerError:
+		whsvr.breaker.recordError()
+	default:
+		whsvr.breaker.recordSuccess()
+	}
+	return resp
+}
+
+// reject admission requests from callers other than the API server before processing them
+func (whsvr *WebhookServer) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if whsvr.apiServerToken != "" && !bearerTokenMatches(r, whsvr.apiServerToken) {
+			glog.Errorf("Unauthorized admission request from %s: invalid bearer token", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if len(whsvr.allowedClientCNs) > 0 {
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				glog.Errorf("Unauthorized admission request from %s: no client certificate", r.RemoteAddr)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if cn := r.TLS.PeerCertificates[0].Subject.CommonName; !contains(whsvr.allowedClientCNs, cn) {
+				glog.Errorf("Forbidden admission request from %s: client certificate CN=%s is not allowed", r.RemoteAddr, cn)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func bearerTokenMatches(r *http.Request, token string) bool {
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// whether the info level logs of a request are emitted, errors are always logged
+func (whsvr *WebhookServer) logSampled() bool {
+	if whsvr.logSampleRate <= 1 {
+		return true
+	}
+	return atomic.AddUint64(&whsvr.requestCount, 1)%uint64(whsvr.logSampleRate) == 1
+}
+
+// info level log of one admission request, silent unless the request is sampled
+type requestLog bool
+
+func (log requestLog) Infof(format string, args ...interface{}) {
+	if log {
+		glog.InfoDepth(1, fmt.Sprintf(format, args...))
+	}
+}
+
+// Subresource of the request, e.g. status for pods/status, "" for the resource itself. Matching an
+// equivalent webhook rule, the API server may convert the request, RequestSubResource then holds the
+// subresource originally requested.
+func requestedSubResource(req *v1beta1.AdmissionRequest) string {
+	if req.RequestSubResource != "" {
+		return req.RequestSubResource
+	}
+	return req.SubResource
+}
+
+// Whether skipTerminatingNamespaces is set and the namespace is being deleted. An error is returned
+// when the namespace can't be looked up.
+func (whsvr *WebhookServer) namespaceTerminating(namespace string) (bool, error) {
+	if !whsvr.config.SkipTerminatingNamespaces {
+		return false, nil
+	}
+	ns, err := whsvr.getNamespace(namespace)
+	if err != nil {
+		return false, fmt.Errorf("could not look up namespace %s: %v", namespace, err)
+	}
+	return ns.Status.Phase == corev1.NamespaceTerminating || ns.DeletionTimestamp != nil, nil
+}
+
+// reason for not mutating pods in the namespace because the required secret is missing, or "".
+// An error is returned when the lookup fails for another reason.
+func (whsvr *WebhookServer) checkRequiredSecret(namespace string) (string, error) {
+	name := whsvr.config.RequiredSecret.Name
+	if name == "" {
+		return "", nil
+	}
+	_, err := whsvr.getSecret(namespace, name)
+	if apierrors.IsNotFound(err) {
+		return fmt.Sprintf("required secret %s/%s does not exist", namespace, name), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not look up required secret %s/%s: %v", namespace, name, err)
+	}
+	return "", nil
+}
+
+// the namespace from the cache, or from the API server when the informer has not seen it yet
+func (whsvr *WebhookServer) getNamespace(name string) (*corev1.Namespace, error) {
+	ns, err := whsvr.namespaceLister.Get(name)
+	if !apierrors.IsNotFound(err) || whsvr.client == nil {
+		return ns, err
+	}
+	err = retryLookup(func() (err error) {
+		ns, err = whsvr.client.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		return err
+	})
+	return ns, err
+}
+
+// the secret from the cache, or from the API server when the informer has not seen it yet, e.g. one
+// created right before the pod
+func (whsvr *WebhookServer) getSecret(namespace, name string) (*corev1.Secret, error) {
+	secret, err := whsvr.secretLister.Secrets(namespace).Get(name)
+	if !apierrors.IsNotFound(err) || whsvr.client == nil {
+		return secret, err
+	}
+	err = retryLookup(func() (err error) {
+		secret, err = whsvr.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		return err
+	})
+	return secret, err
+}
+
+// response to a pod whose cluster lookup failed, retries included: an internal error with failurePolicy
+// Fail, else admitted unmutated with a warning
+func (whsvr *WebhookServer) lookupFailed(err error) *v1beta1.AdmissionResponse {
+	if whsvr.config.FailurePolicy == admissionregistrationv1beta1.Fail {
+		return internalError(err).toAdmissionResponse()
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{err.Error() + ", the pod is not mutated"},
+	}
+}
+
+// Serve method for webhook server
+func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(whsvr.logSampled())
+
+	// a Content-Length over the limit is rejected before reading, chunked requests omit it so the bytes read are checked too
+	if whsvr.maxRequestBytes > 0 && r.ContentLength > whsvr.maxRequestBytes {
+		glog.Errorf("Request body of %d bytes exceeds the %d bytes limit", r.ContentLength, whsvr.maxRequestBytes)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var body []byte
+	if r.Body != nil {
+		reader := io.Reader(r.Body)
+		if whsvr.maxRequestBytes > 0 {
+			reader = io.LimitReader(r.Body, whsvr.maxRequestBytes+1)
+		}
+		if data, err := ioutil.ReadAll(reader); err == nil {
+			body = data
+		}
+	}
+	if whsvr.maxRequestBytes > 0 && int64(len(body)) > whsvr.maxRequestBytes {
+		glog.Errorf("Request body exceeds the %d bytes limit", whsvr.maxRequestBytes)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(body) == 0 {
+		glog.Error("empty body")
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	// verify the content type is accurate, YAML reviews (e.g. from testing tools) are answered in YAML
+	contentType := r.Header.Get("Content-Type")
+	switch contentType {
+	case "application/json":
+	case "application/yaml":
+		data, err := yaml.YAMLToJSON(body)
+		if err != nil {
+			glog.Errorf("Can't convert YAML body: %v", err)
+			http.Error(w, fmt.Sprintf("could not convert YAML body: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = data
+	default:
+		glog.Errorf("Content-Type=%s, expect application/json or application/yaml", contentType)
+		http.Error(w, "invalid Content-Type, expect `application/json` or `application/yaml`", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var admissionResponse *v1beta1.AdmissionResponse
+	ar := v1beta1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+		glog.Errorf("Can't decode body: %v", err)
+		admissionResponse = badRequestError(err).toAdmissionResponse()
+	} else {
+		if ar.Request != nil {
+			req := ar.Request
+			log.Infof("AdmissionReview on %v for Kind=%v, RequestKind=%v SubResource=%v Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v FieldManager=%v",
+				r.URL.Path, req.Kind, req.RequestKind, requestedSubResource(req), req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo, fieldManager(req))
+		}
+		if r.URL.Path == "/mutate" {
+			admissionResponse = whsvr.breakerMutate(r.Context(), &ar, r.Header.Get(profileHeader), log)
+		} else if r.URL.Path == "/validate" {
+			admissionResponse = whsvr.validate(&ar, log)
+		}
+	}
+
+	admissionReview := v1beta1.AdmissionReview{}
+	if admissionResponse != nil {
+		admissionReview.Response = admissionResponse
+		// a patchType without a patch makes the apiserver warn on decoding the response
+		if len(admissionResponse.Patch) == 0 {
+			admissionResponse.Patch, admissionResponse.PatchType = nil, nil
+		}
+		if ar.Request != nil {
+			admissionReview.Response.UID = ar.Request.UID
+		}
+	}
+	if whsvr.decisionLog != nil && ar.Request != nil && admissionResponse != nil {
+		whsvr.decisionLog.record(newDecisionRecord(r.URL.Path, ar.Request, admissionResponse))
+	}
+
+	var resp []byte
+	var err error
+	if whsvr.pretty {
+		resp, err = json.MarshalIndent(admissionReview, "", "  ")
+	} else {
+		resp, err = json.Marshal(admissionReview)
+	}
+	if err == nil && contentType == "application/yaml" {
+		resp, err = yaml.JSONToYAML(resp)
+	}
+	if err != nil {
+		glog.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Ready to write reponse ...")
+	if whsvr.gzipAccepted(r, len(resp)) {
+		if compressed, err := gzipBytes(resp); err != nil {
+			glog.Errorf("Can't compress response, sending it uncompressed: %v", err)
+		} else {
+			w.Header().Set("Content-Encoding", "gzip")
+			resp = compressed
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// whether a response body of size bytes should be sent gzip compressed to the caller
+func (whsvr *WebhookServer) gzipAccepted(r *http.Request, size int) bool {
+	if whsvr.gzipMinBytes <= 0 || size < whsvr.gzipMinBytes {
+		return false
+	}
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		// quality values are ignored
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// field manager from the create or update options of the request, "" when none is given
+func fieldManager(req *v1beta1.AdmissionRequest) string {
+	if len(req.Options.Raw) == 0 {
+		return ""
+	}
+	switch req.Operation {
+	case v1beta1.Create:
+		var options metav1.CreateOptions
+		if err := json.Unmarshal(req.Options.Raw, &options); err != nil {
+			glog.Warningf("Can't decode the CreateOptions of %v: %v", req.UID, err)
+			return ""
+		}
+		return options.FieldManager
+	case v1beta1.Update:
+		var options metav1.UpdateOptions
+		if err := json.Unmarshal(req.Options.Raw, &options); err != nil {
+			glog.Warningf("Can't decode the UpdateOptions of %v: %v", req.UID, err)
+			return ""
+		}
+		return options.FieldManager
+	}
+	return ""
+}
+
+// settings the server is actually running with, configuration file defaults resolved. Files are
+// reported by path, the tokens they hold never are.
+type effectiveConfig struct {
+	Config                 *Config  `json:"config"`
+	Port                   int      `json:"port"`
+	TLSCertFile            string   `json:"tlsCertFile"`
+	TLSKeyFile             string   `json:"tlsKeyFile"`
+	ConfigFile             string   `json:"configFile"`
+	Force                  bool     `json:"force"`
+	LogSampleRate          int      `json:"logSampleRate"`
+	AdminTokenFile         string   `json:"adminTokenFile"`
+	AnnotationPrefix       string   `json:"annotationPrefix"`
+	APIServerTokenFile     string   `json:"apiServerTokenFile"`
+	APIServerTokenRequired bool     `json:"apiServerTokenRequired"`
+	ClientCAFile           string   `json:"clientCAFile"`
+	AllowedClientCNs       []string `json:"allowedClientCNs"`
+	ResponseDelay          string   `json:"responseDelay"`
+	GzipMinBytes           int      `json:"gzipMinBytes"`
+	DecisionLogFile        string   `json:"decisionLogFile"`
+	DecisionLogMaxSize     int64    `json:"decisionLogMaxSize"`
+	PatchWorkers           int      `json:"patchWorkers"`
+	PodSelector            string   `json:"podSelector"`
+	Pretty                 bool     `json:"pretty"`
+	ReadTimeout            string   `json:"readTimeout"`
+	WriteTimeout           string   `json:"writeTimeout"`
+	IdleTimeout            string   `json:"idleTimeout"`
+	MaxHeaderBytes         int      `json:"maxHeaderBytes"`
+	MaxRequestBytes        int64    `json:"maxRequestBytes"`
+	KillSwitchFile         string   `json:"killSwitchFile"`
+	KillSwitchInterval     string   `json:"killSwitchInterval"`
+	BreakerErrors          int      `json:"breakerErrors"`
+	BreakerWindow          string   `json:"breakerWindow"`
+	BreakerCooldown        string   `json:"breakerCooldown"`
+}
+
+func (whsvr *WebhookServer) effectiveConfig() effectiveConfig {
+	parameters := whsvr.parameters
+	return effectiveConfig{
+		Config:                 whsvr.config,
+		Port:                   parameters.port,
+		TLSCertFile:            parameters.certFile,
+		TLSKeyFile:             parameters.keyFile,
+		ConfigFile:             parameters.configFile,
+		Force:                  whsvr.force,
+		LogSampleRate:          whsvr.logSampleRate,
+		AdminTokenFile:         parameters.adminTokenFile,
+		AnnotationPrefix:       annotationPrefix,
+		APIServerTokenFile:     parameters.apiServerTokenFile,
+		APIServerTokenRequired: parameters.apiServerTokenFile != "",
+		ClientCAFile:           parameters.clientCAFile,
+		AllowedClientCNs:       whsvr.allowedClientCNs,
+		ResponseDelay:          whsvr.responseDelay.String(),
+		GzipMinBytes:           whsvr.gzipMinBytes,
+		DecisionLogFile:        parameters.decisionLogFile,
+		DecisionLogMaxSize:     parameters.decisionLogMaxSize,
+		PatchWorkers:           parameters.patchWorkers,
+		PodSelector:            whsvr.podSelector.String(),
+		Pretty:                 whsvr.pretty,
+		ReadTimeout:            parameters.readTimeout.String(),
+		WriteTimeout:           parameters.writeTimeout.String(),
+		IdleTimeout:            parameters.idleTimeout.String(),
+		MaxHeaderBytes:         parameters.maxHeaderBytes,
+		MaxRequestBytes:        whsvr.maxRequestBytes,
+		KillSwitchFile:         parameters.killSwitchFile,
+		KillSwitchInterval:     parameters.killSwitchInterval.String(),
+		BreakerErrors:          parameters.breakerErrors,
+		BreakerWindow:          parameters.breakerWindow.String(),
+		BreakerCooldown:        parameters.breakerCooldown.String(),
+	}
+}
+
+// the effective configuration encoded as json or yaml
+func (whsvr *WebhookServer) marshalEffectiveConfig(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(whsvr.effectiveConfig(), "", "  ")
+	case "yaml":
+		return yaml.Marshal(whsvr.effectiveConfig())
+	default:
+		return nil, fmt.Errorf("unsupported format %q, expect json or yaml", format)
+	}
+}
+
+// Answer load balancer health checks probing "/", any other unregistered path is not found
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// operational status reported by /healthz
+type healthStatus struct {
+	Status            string    `json:"status"`
+	Version           string    `json:"version"`
+	Mutations         []string  `json:"mutations"`         // enabled pod mutations
+	ConfigChecksum    string    `json:"configChecksum"`    // sha256 of the configuration file, empty without one
+	CertificateExpiry time.Time `json:"certificateExpiry"` // zero when the certificate failed to load
+}
+
+// Serve the webhook status, unauthenticated so that it can back kubelet probes
+func (whsvr *WebhookServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(healthStatus{
+		Status:            "ok",
+		Version:           version,
+		Mutations:         whsvr.enabledMutations(),
+		ConfigChecksum:    whsvr.config.checksum,
+		CertificateExpiry: whsvr.certNotAfter,
+	})
+	if err != nil {
+		glog.Errorf("Can't encode status: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write status: %v", err)
+	}
+}
+
+func (whsvr *WebhookServer) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&whsvr.ready, value)
+	if ready {
+		atomic.StoreInt32(&whsvr.started, 1)
+	}
+}
+
+// Refuse admission requests until startup completed. They are still served once shutdown begins, while
+// the API server drains the endpoint.
+func (whsvr *WebhookServer) afterStartup(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&whsvr.started) != 1 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Answer readiness probes, ready once startup completed and until shutdown begins
+func (whsvr *WebhookServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if atomic.LoadInt32(&whsvr.ready) != 1 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Serve the effective configuration to callers presenting the admin token
+func (whsvr *WebhookServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if whsvr.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !bearerTokenMatches(r, whsvr.adminToken) {
+		glog.Errorf("Unauthorized request for the configuration from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp, err := json.Marshal(whsvr.effectiveConfig())
+	if err != nil {
+		glog.Errorf("Can't encode configuration: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write configuration: %v", err)
 	}
 }
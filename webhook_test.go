@@ -0,0 +1,2425 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// temporary file holding the configuration YAML, removed after the test
+func configFile(t testing.TB, data string) string {
+	t.Helper()
+	file, err := ioutil.TempFile("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// configuration loaded from the given YAML, like the mounted configmap
+func testConfig(t testing.TB, data string) *Config {
+	t.Helper()
+	cfg, err := loadConfig(configFile(t, data))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// webhook server set up like main does, without listeners or cluster clients
+func newTestServer(t testing.TB, cfg *Config) *WebhookServer {
+	t.Helper()
+	whsvr := &WebhookServer{
+		config:        cfg,
+		logSampleRate: 1,
+		patchPool:     newWorkerPool(1),
+		podSelector:   labels.Everything(),
+	}
+	for _, check := range []func() error{whsvr.checkRuleModes, whsvr.checkCanary, whsvr.checkPipeline, whsvr.checkProfiles} {
+		if err := check(); err != nil {
+			t.Fatalf("invalid configuration: %v", err)
+		}
+	}
+	return whsvr
+}
+
+func testPod(containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+// CREATE request of the object in its namespace
+func admissionReview(t *testing.T, kind string, namespace string, object interface{}) *v1beta1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "test",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+			Namespace: namespace,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// JSON encoded POST of the review to the path
+func reviewRequest(t *testing.T, path string, review *v1beta1.AdmissionReview) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func decodePatch(t *testing.T, patch []byte) []patchOperation {
+	t.Helper()
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatalf("invalid patch %s: %v", patch, err)
+	}
+	return ops
+}
+
+func patchPaths(ops []patchOperation) []string {
+	var paths []string
+	for _, op := range ops {
+		paths = append(paths, op.Path)
+	}
+	return paths
+}
+
+func TestJSONPointerEscape(t *testing.T) {
+	tests := []struct {
+		segment string
+		want    string
+	}{
+		{segment: "app", want: "app"},
+		{segment: "example.com/team", want: "example.com~1team"},
+		{segment: "a~b", want: "a~0b"},
+		{segment: "a~b/c", want: "a~0b~1c"},
+		// an escaped "/" is not escaped again
+		{segment: "~1", want: "~01"},
+	}
+	for _, test := range tests {
+		if got := jsonPointerEscape(test.segment); got != test.want {
+			t.Errorf("jsonPointerEscape(%q) = %q, want %q", test.segment, got, test.want)
+		}
+	}
+}
+
+func TestMutateNoOp(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantPaths []string
+	}{
+		{
+			name:   "no mutation enabled",
+			config: "",
+		},
+		{
+			name:      "pod labels",
+			config:    "podLabels:\n  team: platform\n",
+			wantPaths: []string{"/metadata/annotations/" + jsonPointerEscape(admissionWebhookAnnotationStatusKey), "/metadata/labels"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, test.config))
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			pod.Annotations = map[string]string{"owner": "platform"}
+
+			resp := whsvr.mutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+			if !resp.Allowed {
+				t.Fatalf("pod denied: %v", resp.Result)
+			}
+			if test.wantPaths == nil {
+				if resp.Patch != nil || resp.PatchType != nil {
+					t.Fatalf("no-op response carries patch %s, patchType %v", resp.Patch, resp.PatchType)
+				}
+				return
+			}
+			if resp.PatchType == nil {
+				t.Fatal("patch without patchType")
+			}
+			paths := patchPaths(decodePatch(t, resp.Patch))
+			for _, want := range test.wantPaths {
+				if !contains(paths, want) {
+					t.Errorf("patch paths %v lack %s", paths, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateDeploymentLabels(t *testing.T) {
+	allLabels := map[string]string{"tier": "web"}
+	for key, value := range addLabels {
+		allLabels[key] = value
+	}
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		wantPaths []string // label paths, the status annotations are patched along
+	}{
+		{
+			name: "no labels",
+			// the first label creates the map
+			wantPaths: []string{
+				"/metadata/labels",
+				"/metadata/labels/" + jsonPointerEscape(instanceLabel),
+				"/metadata/labels/" + jsonPointerEscape(managedByLabel),
+				"/metadata/labels/" + jsonPointerEscape(nameLabel),
+				"/metadata/labels/" + jsonPointerEscape(partOfLabel),
+				"/metadata/labels/" + jsonPointerEscape(versionLabel),
+			},
+		},
+		{
+			name:   "some labels",
+			labels: map[string]string{nameLabel: "web", "tier": "web"},
+			wantPaths: []string{
+				"/metadata/labels/" + jsonPointerEscape(componentLabel),
+				"/metadata/labels/" + jsonPointerEscape(instanceLabel),
+				"/metadata/labels/" + jsonPointerEscape(managedByLabel),
+				"/metadata/labels/" + jsonPointerEscape(partOfLabel),
+				"/metadata/labels/" + jsonPointerEscape(versionLabel),
+			},
+		},
+		{
+			name:   "all labels",
+			labels: allLabels,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, ""))
+			deployment := &appsv1.Deployment{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: test.labels},
+			}
+
+			resp := whsvr.mutate(context.Background(), admissionReview(t, "Deployment", deployment.Namespace, deployment), "", true)
+			if !resp.Allowed {
+				t.Fatalf("deployment denied: %v", resp.Result)
+			}
+			if test.wantPaths == nil {
+				if resp.Patch != nil || resp.PatchType != nil {
+					t.Fatalf("no-op response carries patch %s, patchType %v", resp.Patch, resp.PatchType)
+				}
+				return
+			}
+			var paths []string
+			for _, path := range patchPaths(decodePatch(t, resp.Patch)) {
+				if strings.HasPrefix(path, "/metadata/labels") {
+					paths = append(paths, path)
+				}
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("label paths %v, want %v", paths, test.wantPaths)
+			}
+		})
+	}
+}
+
+func TestMutateConfigChecksum(t *testing.T) {
+	data := "podLabels:\n  team: platform\n"
+	cfg, err := loadConfig(configFile(t, data))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	whsvr := newTestServer(t, cfg)
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	pod.Annotations = map[string]string{"owner": "platform"}
+
+	resp := whsvr.mutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+	if !resp.Allowed {
+		t.Fatalf("pod denied: %v", resp.Result)
+	}
+	want := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	path := "/metadata/annotations/" + jsonPointerEscape(admissionWebhookAnnotationConfigKey)
+	for _, op := range decodePatch(t, resp.Patch) {
+		if op.Path == path {
+			if op.Value != want {
+				t.Errorf("config checksum %v, want %s", op.Value, want)
+			}
+			return
+		}
+	}
+	t.Errorf("patch lacks %s", path)
+}
+
+func TestMarshalEffectiveConfig(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, ""))
+	whsvr.adminToken = "admin-secret"
+	whsvr.apiServerToken = "apiserver-secret"
+	whsvr.parameters = WhSvrParameters{
+		port:               8443,
+		certFile:           "/etc/webhook/certs/cert.pem",
+		apiServerTokenFile: "/etc/webhook/token/token",
+		readTimeout:        10 * time.Second,
+		breakerErrors:      5,
+		killSwitchFile:     "/etc/webhook/kill-switch/on",
+		decisionLogFile:    "/var/log/webhook/decisions.json",
+		patchWorkers:       4,
+	}
+	want := map[string]interface{}{
+		"port":                   8443.0,
+		"tlsCertFile":            "/etc/webhook/certs/cert.pem",
+		"apiServerTokenFile":     "/etc/webhook/token/token",
+		"apiServerTokenRequired": true,
+		"readTimeout":            "10s",
+		"breakerErrors":          5.0,
+		"killSwitchFile":         "/etc/webhook/kill-switch/on",
+		"decisionLogFile":        "/var/log/webhook/decisions.json",
+		"patchWorkers":           4.0,
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			out, err := whsvr.marshalEffectiveConfig(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, token := range []string{whsvr.adminToken, whsvr.apiServerToken} {
+				if strings.Contains(string(out), token) {
+					t.Errorf("output exposes the token %s", token)
+				}
+			}
+			var got map[string]interface{}
+			if err := yaml.Unmarshal(out, &got); err != nil {
+				t.Fatalf("invalid %s: %v", format, err)
+			}
+			for key, value := range want {
+				if got[key] != value {
+					t.Errorf("%s is %v, want %v", key, got[key], value)
+				}
+			}
+		})
+	}
+
+	if _, err := whsvr.marshalEffectiveConfig("toml"); err == nil {
+		t.Error("unsupported format accepted")
+	}
+}
+
+func TestServeProfileHeader(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, `
+podLabels:
+  team: platform
+priorityClassName: standard
+profiles:
+  labels-only: ["pod-labels"]
+  none: []
+`))
+	labelsPath := "/metadata/labels"
+	priorityPath := "/spec/priorityClassName"
+	tests := []struct {
+		name      string
+		profile   string
+		wantPaths []string
+		noPatch   bool
+	}{
+		{name: "no header", wantPaths: []string{labelsPath, priorityPath}},
+		{name: "profile", profile: "labels-only", wantPaths: []string{labelsPath}},
+		{name: "empty profile", profile: "none", noPatch: true},
+		{name: "unknown profile", profile: "missing", wantPaths: []string{labelsPath, priorityPath}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			r := reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod))
+			if test.profile != "" {
+				r.Header.Set(profileHeader, test.profile)
+			}
+			w := httptest.NewRecorder()
+			whsvr.serve(w, r)
+
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body, err)
+			}
+			if test.noPatch {
+				if review.Response.Patch != nil {
+					t.Fatalf("unexpected patch %s", review.Response.Patch)
+				}
+				return
+			}
+			paths := patchPaths(decodePatch(t, review.Response.Patch))
+			for _, path := range []string{labelsPath, priorityPath} {
+				if want := contains(test.wantPaths, path); contains(paths, path) != want {
+					t.Errorf("patch paths %v, want %s: %v", paths, path, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckProfiles(t *testing.T) {
+	whsvr := &WebhookServer{config: testConfig(t, "profiles:\n  broken: [\"no-such-mutation\"]\n")}
+	if err := whsvr.checkProfiles(); err == nil {
+		t.Error("profile of an unknown mutation accepted")
+	}
+}
+
+func TestValidatePod(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		namespace    string            // default when empty
+		pod          func(*corev1.Pod) // changes to a pod running nginx:1.19 in the app container
+		wantDenied   string            // part of the denial message, the pod is admitted when empty
+		wantWarnings int
+	}{
+		{
+			name:       "default service account denied",
+			config:     "defaultServiceAccount:\n  enabled: true\n",
+			wantDenied: "explicit serviceAccountName",
+		},
+		{
+			name:       "explicit default service account denied",
+			config:     "defaultServiceAccount:\n  enabled: true\n",
+			pod:        func(pod *corev1.Pod) { pod.Spec.ServiceAccountName = "default" },
+			wantDenied: "explicit serviceAccountName",
+		},
+		{
+			name:   "named service account allowed",
+			config: "defaultServiceAccount:\n  enabled: true\n",
+			pod:    func(pod *corev1.Pod) { pod.Spec.ServiceAccountName = "app" },
+		},
+		{
+			name:      "default service account in exempt namespace allowed",
+			config:    "defaultServiceAccount:\n  enabled: true\n  exemptions:\n    namespaces: [\"kube-system\"]\n",
+			namespace: "kube-system",
+		},
+		{
+			name:      "default service account outside the enforced namespaces allowed",
+			config:    "defaultServiceAccount:\n  enabled: true\n  namespaces: [\"production\"]\n",
+			namespace: "staging",
+		},
+		{
+			name:   "default service account rule disabled",
+			config: "defaultServiceAccount:\n  enabled: false\n",
+		},
+		{
+			name:   "containers within the limit allowed",
+			config: "maxContainers: 2\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+			},
+		},
+		{
+			name:   "init containers count towards the limit",
+			config: "maxContainers: 1\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+			},
+			wantDenied: "pod declares 2 containers, at most 1 are allowed",
+		},
+		{
+			name:   "denied capability",
+			config: "deniedCapabilities: [\"SYS_ADMIN\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_BIND_SERVICE", "CAP_SYS_ADMIN"}},
+				}
+			},
+			wantDenied: "app adds CAP_SYS_ADMIN",
+		},
+		{
+			name:   "capability of an init container denied",
+			config: "deniedCapabilities: [\"net_raw\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{
+					Name:            "init",
+					Image:           "busybox:1.32",
+					SecurityContext: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_RAW"}}},
+				}}
+			},
+			wantDenied: "init adds NET_RAW",
+		},
+		{
+			name:   "other capability allowed",
+			config: "deniedCapabilities: [\"SYS_ADMIN\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_BIND_SERVICE"}},
+				}
+			},
+		},
+		{
+			name:       "host network denied",
+			config:     "hostNamespaces:\n  denyHostNetwork: true\n  denyHostPID: true\n",
+			pod:        func(pod *corev1.Pod) { pod.Spec.HostNetwork, pod.Spec.HostPID = true, true },
+			wantDenied: "pods may not set hostNetwork, hostPID",
+		},
+		{
+			name:   "host namespace not denied by the configuration allowed",
+			config: "hostNamespaces:\n  denyHostNetwork: true\n",
+			pod:    func(pod *corev1.Pod) { pod.Spec.HostIPC = true },
+		},
+		{
+			name:   "host network of an exempt service account allowed",
+			config: "hostNamespaces:\n  denyHostNetwork: true\n  exemptions:\n    serviceAccounts: [\"default/node-agent\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.HostNetwork = true
+				pod.Spec.ServiceAccountName = "node-agent"
+			},
+		},
+		{
+			name:       "latest image tag denied",
+			config:     "latestImageTag:\n  enabled: true\n",
+			pod:        func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "nginx" },
+			wantDenied: "app (nginx)",
+		},
+		{
+			name:         "latest image tag warned about",
+			config:       "latestImageTag:\n  enabled: true\n  action: Warn\n",
+			pod:          func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "registry.example.com:5000/nginx:latest" },
+			wantWarnings: 1,
+		},
+		{
+			name:   "image pinned by digest allowed",
+			config: "latestImageTag:\n  enabled: true\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Image = "nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+			},
+		},
+		{
+			name:      "latest image tag in an exempt namespace allowed",
+			config:    "latestImageTag:\n  enabled: true\n  exemptions:\n    namespaces: [\"kube-system\"]\n",
+			pod:       func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "nginx:latest" },
+			namespace: "kube-system",
+		},
+		{
+			name:   "denied env var",
+			config: "deniedEnvVars: [\"AWS_SECRET*\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "AWS_REGION"}, {Name: "AWS_SECRET_ACCESS_KEY"}}
+			},
+			wantDenied: "app sets AWS_SECRET_ACCESS_KEY",
+		},
+		{
+			name:   "other env var allowed",
+			config: "deniedEnvVars: [\"AWS_SECRET*\"]\n",
+			pod:    func(pod *corev1.Pod) { pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "AWS_REGION"}} },
+		},
+		{
+			name:   "privileged container denied",
+			config: "privilegedContainers:\n  enabled: true\n",
+			pod: func(pod *corev1.Pod) {
+				privileged := true
+				pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			},
+			wantDenied: "containers may not run privileged: app",
+		},
+		{
+			name:   "privileged container in an exempt namespace allowed",
+			config: "privilegedContainers:\n  enabled: true\n  exemptions:\n    namespaces: [\"kube-system\"]\n",
+			pod: func(pod *corev1.Pod) {
+				privileged := true
+				pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			},
+			namespace: "kube-system",
+		},
+		{
+			name:       "container without probes denied",
+			config:     "probes:\n  enabled: true\n",
+			wantDenied: "liveness or readiness probe: app",
+		},
+		{
+			name:   "container with a readiness probe allowed",
+			config: "probes:\n  enabled: true\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+					Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(80)}},
+				}
+			},
+		},
+		{
+			name:   "exempt container without probes allowed",
+			config: "probes:\n  enabled: true\n  exemptContainers: [\"app\"]\n",
+		},
+		{
+			name:         "container without probes warned about",
+			config:       "probes:\n  enabled: true\n  action: Warn\n",
+			wantWarnings: 1,
+		},
+		{
+			name:       "pod without the image size attestation denied",
+			config:     "imageSizeAttestation:\n  annotationKey: ci.example.com/image-size-compliant\n",
+			wantDenied: "ci.example.com/image-size-compliant=true",
+		},
+		{
+			name:   "attested pod allowed",
+			config: "imageSizeAttestation:\n  annotationKey: ci.example.com/image-size-compliant\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{"ci.example.com/image-size-compliant": "true"}
+			},
+		},
+		{
+			name:       "malformed annotation denied",
+			config:     "annotationFormats:\n  example.com/cost-center: \"CC-[0-9]{4}\"\n",
+			pod:        func(pod *corev1.Pod) { pod.Annotations = map[string]string{"example.com/cost-center": "CC-12345"} },
+			wantDenied: `example.com/cost-center="CC-12345" must match CC-[0-9]{4}`,
+		},
+		{
+			name:   "well-formed annotation allowed",
+			config: "annotationFormats:\n  example.com/cost-center: \"CC-[0-9]{4}\"\n",
+			pod:    func(pod *corev1.Pod) { pod.Annotations = map[string]string{"example.com/cost-center": "CC-1234"} },
+		},
+		{
+			name:   "missing annotation allowed",
+			config: "annotationFormats:\n  example.com/cost-center: \"CC-[0-9]{4}\"\n",
+		},
+		{
+			name:   "rule in audit mode warns",
+			config: "privilegedContainers:\n  enabled: true\nruleModes:\n  privileged-containers: Audit\n",
+			pod: func(pod *corev1.Pod) {
+				privileged := true
+				pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:       "warning rule in enforce mode denies",
+			config:     "latestImageTag:\n  enabled: true\n  action: Warn\nruleModes:\n  latest-image-tag: Enforce\n",
+			pod:        func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "nginx" },
+			wantDenied: "app (nginx)",
+		},
+		{
+			name:   "denial rendered with the template",
+			config: "denyMessageTemplate: \"{{.Rule}} in {{.Namespace}}: {{.Reason}}\"\nmaxContainers: 1\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+			},
+			wantDenied: "max-containers in default: pod declares 2 containers",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, test.config))
+			namespace := test.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			pod.Namespace = namespace
+			if test.pod != nil {
+				test.pod(pod)
+			}
+
+			resp := whsvr.validatePod(namespace, &pod.ObjectMeta, &pod.Spec, true)
+			if test.wantDenied == "" {
+				if !resp.Allowed {
+					t.Errorf("pod denied: %s", resp.Result.Message)
+				}
+			} else if resp.Allowed {
+				t.Errorf("pod admitted, want denial %q", test.wantDenied)
+			} else if !strings.Contains(resp.Result.Message, test.wantDenied) {
+				t.Errorf("denial %q, want %q", resp.Result.Message, test.wantDenied)
+			}
+			if len(resp.Warnings) != test.wantWarnings {
+				t.Errorf("warnings %v, want %d", resp.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestCheckRuleModes(t *testing.T) {
+	whsvr := &WebhookServer{config: testConfig(t, "ruleModes:\n  no-such-rule: Audit\n")}
+	if err := whsvr.checkRuleModes(); err == nil {
+		t.Error("mode of an unknown rule accepted")
+	}
+}
+
+func TestValidatePodCountsDenials(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "maxContainers: 1\ndeniedEnvVars: [\"AWS_SECRET*\"]\n"))
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19", Env: []corev1.EnvVar{{Name: "AWS_SECRET_ACCESS_KEY"}}})
+	pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+	before := map[string]float64{}
+	for _, rule := range []string{"max-containers", "denied-env-vars", "probes"} {
+		before[rule] = testutil.ToFloat64(validationDenials.WithLabelValues(rule))
+	}
+
+	if resp := whsvr.validatePod(pod.Namespace, &pod.ObjectMeta, &pod.Spec, true); resp.Allowed {
+		t.Fatal("pod admitted")
+	}
+	for rule, want := range map[string]float64{"max-containers": 1, "denied-env-vars": 1, "probes": 0} {
+		if got := testutil.ToFloat64(validationDenials.WithLabelValues(rule)) - before[rule]; got != want {
+			t.Errorf("%s denials increased by %v, want %v", rule, got, want)
+		}
+	}
+}
+
+func TestDefaultServiceAccountNamespaceSelector(t *testing.T) {
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, environment := range map[string]string{"shop": "production", "sandbox": "development"} {
+		if err := namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"environment": environment}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	whsvr := newTestServer(t, testConfig(t, `
+defaultServiceAccount:
+  enabled: true
+  namespaces: ["payments"]
+  namespaceSelector: environment=production
+`))
+	whsvr.namespaceLister = corelisters.NewNamespaceLister(namespaces)
+
+	tests := []struct {
+		namespace  string
+		wantDenied bool
+	}{
+		{namespace: "shop", wantDenied: true},
+		{namespace: "payments", wantDenied: true},
+		{namespace: "sandbox"},
+		// fails closed, the namespace may match
+		{namespace: "unknown", wantDenied: true},
+	}
+	for _, test := range tests {
+		t.Run(test.namespace, func(t *testing.T) {
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			pod.Namespace = test.namespace
+			if resp := whsvr.validatePod(pod.Namespace, &pod.ObjectMeta, &pod.Spec, true); resp.Allowed == test.wantDenied {
+				t.Errorf("allowed %v, want %v", resp.Allowed, !test.wantDenied)
+			}
+		})
+	}
+}
+
+func pipelineNames(pipeline []patchBuilder) []string {
+	var names []string
+	for _, builder := range pipeline {
+		names = append(names, builder.name)
+	}
+	return names
+}
+
+func TestCheckPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantRun   []string // mutations running one after the other
+		wantFirst bool     // wantRun starts the pipeline
+		wantErr   string
+	}{
+		{name: "default order", wantRun: []string{"pod-labels"}, wantFirst: true},
+		{
+			name:      "configured steps run first",
+			config:    "mutationPipeline:\n  - name: env-from\n  - name: dns\n",
+			wantRun:   []string{"env-from", "dns"},
+			wantFirst: true,
+		},
+		{
+			name:    "configured step waits for its default dependencies",
+			config:  "mutationPipeline:\n  - name: gomaxprocs\n",
+			wantRun: []string{"resource-defaults", "gomaxprocs"},
+		},
+		{
+			name:    "configured dependency",
+			config:  "mutationPipeline:\n  - name: topology-spread-constraints\n    after: [\"env-from\"]\n",
+			wantRun: []string{"env-from", "topology-spread-constraints"},
+		},
+		{
+			name:    "unknown mutation",
+			config:  "mutationPipeline:\n  - name: no-such-mutation\n",
+			wantErr: "unknown mutation no-such-mutation",
+		},
+		{
+			name:    "duplicate mutation",
+			config:  "mutationPipeline:\n  - name: dns\n  - name: dns\n",
+			wantErr: "duplicate mutation dns",
+		},
+		{
+			name:    "unknown dependency",
+			config:  "mutationPipeline:\n  - name: dns\n    after: [\"no-such-mutation\"]\n",
+			wantErr: "dns runs after unknown mutation no-such-mutation",
+		},
+		{
+			name:    "cycle",
+			config:  "mutationPipeline:\n  - name: resource-defaults\n    after: [\"gomaxprocs\"]\n",
+			wantErr: "dependency cycle",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := &WebhookServer{config: testConfig(t, test.config)}
+			err := whsvr.checkPipeline()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := pipelineNames(whsvr.pipeline)
+			if len(names) != len(whsvr.podPatchBuilders()) {
+				t.Fatalf("pipeline %v lacks mutations", names)
+			}
+			position := map[string]int{}
+			for i, name := range names {
+				position[name] = i
+			}
+			start := position[test.wantRun[0]]
+			if test.wantFirst && start != 0 {
+				t.Errorf("pipeline %v does not start with %s", names, test.wantRun[0])
+			}
+			for i, want := range test.wantRun {
+				if position[want] != start+i {
+					t.Fatalf("pipeline %v does not run %v one after the other", names, test.wantRun)
+				}
+			}
+			for _, builder := range whsvr.pipeline {
+				for _, dependency := range builder.after {
+					if position[dependency] > position[builder.name] {
+						t.Errorf("%s runs before its dependency %s", builder.name, dependency)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCreatePatchFailurePolicy(t *testing.T) {
+	pipeline := []patchBuilder{
+		{name: "broken", enabled: true, build: func(m *podMutation) ([]patchOperation, error) {
+			return []patchOperation{{Op: "add", Path: "/spec/broken"}}, errors.New("cannot build")
+		}},
+		{name: "working", enabled: true, build: func(m *podMutation) ([]patchOperation, error) {
+			return []patchOperation{{Op: "add", Path: "/spec/working"}}, nil
+		}},
+	}
+	tests := []struct {
+		failurePolicy string
+		wantErr       bool
+	}{
+		{failurePolicy: "Fail", wantErr: true},
+		{failurePolicy: "Ignore"},
+	}
+	for _, test := range tests {
+		t.Run(test.failurePolicy, func(t *testing.T) {
+			whsvr := &WebhookServer{config: testConfig(t, "failurePolicy: "+test.failurePolicy+"\n"), pipeline: pipeline}
+			mutation := &podMutation{pod: testPod(corev1.Container{Name: "app", Image: "nginx:1.19"}), namespace: "default"}
+			patch, err := whsvr.createPatch("Pod", mutation, nil, map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}, nil, nil)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "mutation broken failed") {
+					t.Fatalf("error %v, want the broken mutation to fail the request", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := patchPaths(decodePatch(t, patch))
+			if contains(paths, "/spec/broken") || !contains(paths, "/spec/working") {
+				t.Errorf("patch paths %v, want only the working mutation", paths)
+			}
+		})
+	}
+}
+
+func TestCreatePatchFailedMutationRolledBack(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, "failurePolicy: Ignore\nimagePullPolicy: Always\n"))
+	pipeline := []patchBuilder{{name: "broken", enabled: true, build: func(m *podMutation) ([]patchOperation, error) {
+		// fails after changing the pod, like a sidecar appended before an error
+		m.pod.Spec.Containers = append(m.pod.Spec.Containers, corev1.Container{Name: "half-injected", Image: "busybox:1.32"})
+		return nil, errors.New("cannot build")
+	}}}
+	whsvr.pipeline = append(pipeline, whsvr.pipeline...)
+	mutation := &podMutation{pod: testPod(corev1.Container{Name: "app", Image: "nginx:1.19"}), namespace: "default"}
+
+	patch, err := whsvr.createPatch("Pod", mutation, nil, map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := patchPaths(decodePatch(t, patch))
+	if contains(paths, "/spec/containers/1/imagePullPolicy") || !contains(paths, "/spec/containers/0/imagePullPolicy") {
+		t.Errorf("patch paths %v, want only the app container patched", paths)
+	}
+	if containers := mutation.pod.Spec.Containers; len(containers) != 1 {
+		t.Errorf("containers %v left by the failed mutation", containers)
+	}
+}
+
+func TestCreatePatchMaxOperations(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantPatch bool
+		wantErr   bool
+	}{
+		{name: "within the limit", config: "maxPatchOperations: 10\n", wantPatch: true},
+		{name: "no limit", config: "maxPatchOperations: 0\n", wantPatch: true},
+		{name: "over the limit fails", config: "maxPatchOperations: 2\nfailurePolicy: Fail\n", wantErr: true},
+		{name: "over the limit admits unmutated", config: "maxPatchOperations: 2\nfailurePolicy: Ignore\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, test.config+"podLabels:\n  team: platform\n  tier: web\n"))
+			mutation := &podMutation{pod: testPod(corev1.Container{Name: "app", Image: "nginx:1.19"}), namespace: "default"}
+			annotations := map[string]string{admissionWebhookAnnotationStatusKey: "mutated", admissionWebhookAnnotationVersionKey: "test"}
+			patch, err := whsvr.createPatch("Pod", mutation, nil, annotations, nil, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if (patch != nil) != test.wantPatch {
+				t.Errorf("patch %s, want patch %v", patch, test.wantPatch)
+			}
+		})
+	}
+}
+
+func TestServeMaxRequestBytes(t *testing.T) {
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	size := reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod)).ContentLength
+	tests := []struct {
+		name            string
+		maxRequestBytes int64
+		chunked         bool
+		wantStatus      int
+	}{
+		{name: "within the limit", maxRequestBytes: size, wantStatus: http.StatusOK},
+		{name: "no limit", wantStatus: http.StatusOK},
+		{name: "content length over the limit", maxRequestBytes: size - 1, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked body over the limit", maxRequestBytes: size - 1, chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked body within the limit", maxRequestBytes: size, chunked: true, wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, ""))
+			whsvr.maxRequestBytes = test.maxRequestBytes
+			r := reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod))
+			if test.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			whsvr.serve(w, r)
+			if w.Code != test.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServeGzip(t *testing.T) {
+	tests := []struct {
+		name           string
+		gzipMinBytes   int
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "accepted", gzipMinBytes: 1, acceptEncoding: "gzip", wantGzip: true},
+		{name: "accepted among others", gzipMinBytes: 1, acceptEncoding: "deflate, gzip;q=0.5", wantGzip: true},
+		{name: "not accepted", gzipMinBytes: 1, acceptEncoding: "deflate"},
+		{name: "below the minimum size", gzipMinBytes: 1 << 20, acceptEncoding: "gzip"},
+		{name: "disabled", acceptEncoding: "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+			whsvr.gzipMinBytes = test.gzipMinBytes
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			r := reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod))
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+			w := httptest.NewRecorder()
+			whsvr.serve(w, r)
+
+			body := w.Body.Bytes()
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != test.wantGzip {
+				t.Fatalf("gzip %v, want %v", gzipped, test.wantGzip)
+			}
+			if test.wantGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = ioutil.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(body, &review); err != nil || review.Response == nil || review.Response.Patch == nil {
+				t.Errorf("response %s is not a review with a patch: %v", body, err)
+			}
+		})
+	}
+}
+
+func TestServePretty(t *testing.T) {
+	for _, pretty := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pretty %v", pretty), func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+			whsvr.pretty = pretty
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			w := httptest.NewRecorder()
+			whsvr.serve(w, reviewRequest(t, "/mutate", admissionReview(t, "Pod", pod.Namespace, pod)))
+
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("invalid review %s: %v", w.Body, err)
+			}
+			want, err := json.Marshal(review)
+			if pretty {
+				want, err = json.MarshalIndent(review, "", "  ")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != string(want) {
+				t.Errorf("response\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestServeContentType(t *testing.T) {
+	pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+	review, err := json.Marshal(admissionReview(t, "Pod", pod.Namespace, pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlReview, err := yaml.JSONToYAML(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantStatus  int
+	}{
+		{name: "json", contentType: "application/json", body: review, wantStatus: http.StatusOK},
+		{name: "yaml", contentType: "application/yaml", body: yamlReview, wantStatus: http.StatusOK},
+		{name: "invalid yaml", contentType: "application/yaml", body: []byte("request: [unclosed"), wantStatus: http.StatusBadRequest},
+		{name: "unsupported content type", contentType: "text/plain", body: review, wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+			whsvr.serve(w, r)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			// answered in the request encoding
+			if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+				t.Errorf("Content-Type %s, want %s", contentType, test.contentType)
+			}
+			var response v1beta1.AdmissionReview
+			if err := yaml.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Response == nil {
+				t.Fatalf("response %s is not a review: %v", w.Body, err)
+			}
+			if response.Response.UID != "test" || response.Response.Patch == nil {
+				t.Errorf("response %+v, want the patch of request test", response.Response)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name             string
+		apiServerToken   string
+		allowedClientCNs []string
+		authorization    string
+		clientCN         string // no client certificate when empty
+		wantStatus       int
+	}{
+		{name: "no authentication configured", wantStatus: http.StatusOK},
+		{name: "valid token", apiServerToken: "secret", authorization: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "invalid token", apiServerToken: "secret", authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "missing token", apiServerToken: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "allowed client", allowedClientCNs: []string{"kube-apiserver"}, clientCN: "kube-apiserver", wantStatus: http.StatusOK},
+		{name: "other client", allowedClientCNs: []string{"kube-apiserver"}, clientCN: "intruder", wantStatus: http.StatusForbidden},
+		{name: "no client certificate", allowedClientCNs: []string{"kube-apiserver"}, wantStatus: http.StatusUnauthorized},
+		{
+			name:             "valid token from another client",
+			apiServerToken:   "secret",
+			allowedClientCNs: []string{"kube-apiserver"},
+			authorization:    "Bearer secret",
+			clientCN:         "intruder",
+			wantStatus:       http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := &WebhookServer{apiServerToken: test.apiServerToken, allowedClientCNs: test.allowedClientCNs}
+			handler := whsvr.authorize(func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			if test.clientCN != "" {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: test.clientCN}}}}
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+// "op path" of the patch operations the named pod mutation emits, the operations as the API server
+// decodes them and the mutation state it leaves
+func runPodMutation(t *testing.T, whsvr *WebhookServer, name string, pod *corev1.Pod) ([]string, []patchOperation, *podMutation) {
+	t.Helper()
+	for _, builder := range whsvr.pipeline {
+		if builder.name != name {
+			continue
+		}
+		if !builder.enabled {
+			t.Fatalf("mutation %s not enabled by the configuration", name)
+		}
+		m := &podMutation{pod: pod, namespace: pod.Namespace, uid: "test"}
+		patch, err := builder.build(m)
+		if err != nil {
+			t.Fatalf("build %s: %v", name, err)
+		}
+		var ops []string
+		for _, op := range patch {
+			ops = append(ops, op.Op+" "+op.Path)
+		}
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ops, decodePatch(t, patchBytes), m
+	}
+	t.Fatalf("no mutation %s", name)
+	return nil, nil, nil
+}
+
+// fields of the container a sidecar patch operation adds, alone or as the first of a new list
+func patchedContainer(t *testing.T, op patchOperation) map[string]interface{} {
+	t.Helper()
+	value := op.Value
+	if list, ok := value.([]interface{}); ok && len(list) > 0 {
+		value = list[0]
+	}
+	container, ok := value.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s %s value %v is not a container", op.Op, op.Path, op.Value)
+	}
+	return container
+}
+
+// whether the configuration enables the named pod mutation
+func mutationEnabled(t *testing.T, whsvr *WebhookServer, name string) bool {
+	t.Helper()
+	for _, builder := range whsvr.pipeline {
+		if builder.name == name {
+			return builder.enabled
+		}
+	}
+	t.Fatalf("no mutation %s", name)
+	return false
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+func TestPodMutations(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		mutation     string
+		force        bool
+		disabled     bool              // the configuration leaves the mutation disabled
+		native       bool              // the cluster supports native sidecars
+		pod          func(*corev1.Pod) // changes to a pod running nginx:1.19 in the app container
+		wantOps      []string          // "op path" of each operation, in order
+		wantWarnings int
+		check        func(*testing.T, *corev1.Pod) // of the pod the mutation leaves, which later mutations patch against
+		checkPatch   func(*testing.T, []patchOperation)
+	}{
+		{
+			name:     "pod labels added",
+			config:   "podLabels:\n  team: platform\n",
+			mutation: "pod-labels",
+			wantOps:  []string{"add /metadata/labels", "add /metadata/labels/team"},
+		},
+		{
+			name:     "pod label key escaped",
+			config:   "podLabels:\n  example.com/team: platform\n",
+			mutation: "pod-labels",
+			pod:      func(pod *corev1.Pod) { pod.Labels = map[string]string{"app": "web"} },
+			wantOps:  []string{"add /metadata/labels/example.com~1team"},
+		},
+		{
+			name:     "existing pod label kept",
+			config:   "podLabels:\n  team: platform\n",
+			mutation: "pod-labels",
+			pod:      func(pod *corev1.Pod) { pod.Labels = map[string]string{"team": "web"} },
+		},
+		{
+			name:     "existing pod label forced",
+			config:   "podLabels:\n  team: platform\n",
+			mutation: "pod-labels",
+			force:    true,
+			pod:      func(pod *corev1.Pod) { pod.Labels = map[string]string{"team": "web"} },
+			wantOps:  []string{"replace /metadata/labels/team"},
+		},
+		{
+			name:     "priority class set",
+			config:   "priorityClassName: high\n",
+			mutation: "priority-class-name",
+			wantOps:  []string{"add /spec/priorityClassName"},
+		},
+		{
+			name:     "existing priority class kept",
+			config:   "priorityClassName: high\n",
+			mutation: "priority-class-name",
+			pod:      func(pod *corev1.Pod) { pod.Spec.PriorityClassName = "low" },
+		},
+		{
+			name:     "existing priority class forced",
+			config:   "priorityClassName: high\n",
+			mutation: "priority-class-name",
+			force:    true,
+			pod:      func(pod *corev1.Pod) { pod.Spec.PriorityClassName = "low" },
+			wantOps:  []string{"replace /spec/priorityClassName"},
+		},
+		{
+			name:     "runtime class set",
+			config:   "runtimeClass:\n  name: gvisor\n",
+			mutation: "runtime-class-name",
+			wantOps:  []string{"add /spec/runtimeClassName"},
+		},
+		{
+			name:     "runtime class outside the targeted namespaces",
+			config:   "runtimeClass:\n  name: gvisor\n  namespaces: [\"sandbox\"]\n",
+			mutation: "runtime-class-name",
+		},
+		{
+			name:     "runtime class opted out",
+			config:   "runtimeClass:\n  name: gvisor\n",
+			mutation: "runtime-class-name",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationRuntimeKey: "false"}
+			},
+		},
+		{
+			name:     "dns policy and config set",
+			config:   "dns:\n  policy: None\n  config:\n    nameservers: [\"10.0.0.10\"]\n",
+			mutation: "dns",
+			wantOps:  []string{"add /spec/dnsConfig", "add /spec/dnsPolicy"},
+		},
+		{
+			name:     "existing dns policy kept",
+			config:   "dns:\n  policy: None\n  config:\n    nameservers: [\"10.0.0.10\"]\n",
+			mutation: "dns",
+			pod:      func(pod *corev1.Pod) { pod.Spec.DNSPolicy = corev1.DNSDefault },
+			wantOps:  []string{"add /spec/dnsConfig"},
+		},
+		{
+			name:     "zone affinity added",
+			config:   "zoneAffinity:\n  zones: [\"eu-west-1a\"]\n",
+			mutation: "zone-affinity",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationZoneKey: "eu-west-1a"}
+			},
+			wantOps: []string{"add /spec/affinity"},
+		},
+		{
+			name:     "zone requirement added to every node selector term",
+			config:   "zoneAffinity:\n  zones: [\"eu-west-1a\"]\n",
+			mutation: "zone-affinity",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationZoneKey: "eu-west-1a"}
+				gpu := corev1.NodeSelectorRequirement{Key: "gpu", Operator: corev1.NodeSelectorOpExists}
+				pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{gpu}},
+						{},
+					}},
+				}}
+			},
+			wantOps: []string{
+				"add /spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0/matchExpressions/-",
+				"add /spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/1/matchExpressions",
+			},
+		},
+		{
+			name:     "unknown zone ignored",
+			config:   "zoneAffinity:\n  zones: [\"eu-west-1a\"]\n",
+			mutation: "zone-affinity",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationZoneKey: "us-east-1a"}
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:     "tolerations added",
+			config:   "tolerations:\n  - key: dedicated\n    operator: Equal\n    value: sidecars\n    effect: NoSchedule\n",
+			mutation: "tolerations",
+			wantOps:  []string{"add /spec/tolerations"},
+		},
+		{
+			name:     "tolerations appended",
+			config:   "tolerations:\n  - key: dedicated\n    operator: Equal\n    value: sidecars\n    effect: NoSchedule\n",
+			mutation: "tolerations",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = []corev1.Toleration{{Key: "gpu", Operator: corev1.TolerationOpExists}}
+			},
+			wantOps: []string{"add /spec/tolerations/-"},
+		},
+		{
+			name:     "existing toleration kept",
+			config:   "tolerations:\n  - key: dedicated\n    operator: Equal\n    value: sidecars\n    effect: NoSchedule\n",
+			mutation: "tolerations",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "sidecars", Effect: corev1.TaintEffectNoSchedule}}
+			},
+		},
+		{
+			name:     "default termination grace period injected",
+			config:   "terminationGracePeriodSeconds: 60\n",
+			mutation: "termination-grace-period",
+			wantOps:  []string{"add /spec/terminationGracePeriodSeconds"},
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if seconds := pod.Spec.TerminationGracePeriodSeconds; seconds == nil || *seconds != 60 {
+					t.Errorf("terminationGracePeriodSeconds %v, want 60", seconds)
+				}
+			},
+		},
+		{
+			name:     "user termination grace period preserved",
+			config:   "terminationGracePeriodSeconds: 60\n",
+			mutation: "termination-grace-period",
+			pod:      func(pod *corev1.Pod) { pod.Spec.TerminationGracePeriodSeconds = int64Ptr(10) },
+		},
+		{
+			name:     "termination grace period disabled",
+			mutation: "termination-grace-period",
+			disabled: true,
+		},
+		{
+			name:     "termination grace period set",
+			config:   "minTerminationGracePeriodSeconds: 60\n",
+			mutation: "termination-grace-period",
+			wantOps:  []string{"add /spec/terminationGracePeriodSeconds"},
+		},
+		{
+			name:     "lower termination grace period raised",
+			config:   "minTerminationGracePeriodSeconds: 60\n",
+			mutation: "termination-grace-period",
+			pod:      func(pod *corev1.Pod) { pod.Spec.TerminationGracePeriodSeconds = int64Ptr(30) },
+			wantOps:  []string{"replace /spec/terminationGracePeriodSeconds"},
+		},
+		{
+			name:     "higher termination grace period kept",
+			config:   "minTerminationGracePeriodSeconds: 60\n",
+			mutation: "termination-grace-period",
+			pod:      func(pod *corev1.Pod) { pod.Spec.TerminationGracePeriodSeconds = int64Ptr(120) },
+		},
+		{
+			name:     "fsGroup set",
+			config:   "fsGroup: 2000\n",
+			mutation: "fs-group",
+			wantOps:  []string{"add /spec/securityContext"},
+		},
+		{
+			name:     "fsGroup merged into the security context",
+			config:   "fsGroup: 2000\n",
+			mutation: "fs-group",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: int64Ptr(1000)}
+			},
+			wantOps: []string{"add /spec/securityContext/fsGroup"},
+		},
+		{
+			name:     "fsGroup disabled",
+			mutation: "fs-group",
+			disabled: true,
+		},
+		{
+			name:     "existing fsGroup kept",
+			config:   "fsGroup: 2000\n",
+			mutation: "fs-group",
+			pod:      func(pod *corev1.Pod) { pod.Spec.SecurityContext = &corev1.PodSecurityContext{FSGroup: int64Ptr(1000)} },
+		},
+		{
+			name:     "pull policy set",
+			config:   "imagePullPolicy: Always\nexcludeContainers: [\"istio-proxy\"]\n",
+			mutation: "image-pull-policy",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.8.0"})
+			},
+			wantOps: []string{"add /spec/initContainers/0/imagePullPolicy", "add /spec/containers/0/imagePullPolicy"},
+		},
+		{
+			name:     "pull policy defaulted from the image tag replaced",
+			config:   "imagePullPolicy: Always\n",
+			mutation: "image-pull-policy",
+			pod:      func(pod *corev1.Pod) { pod.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent },
+			wantOps:  []string{"replace /spec/containers/0/imagePullPolicy"},
+		},
+		{
+			name:     "explicit pull policy kept",
+			config:   "imagePullPolicy: Always\n",
+			mutation: "image-pull-policy",
+			pod:      func(pod *corev1.Pod) { pod.Spec.Containers[0].ImagePullPolicy = corev1.PullNever },
+		},
+		{
+			name:     "latest image pulled always",
+			config:   "latestImageTag:\n  pullAlways: true\n",
+			mutation: "latest-image-pull-policy",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "worker", Image: "worker:latest"})
+			},
+			wantOps: []string{"add /spec/containers/1/imagePullPolicy"},
+		},
+		{
+			name:     "preStop hook added",
+			config:   "preStop:\n  handler:\n    exec:\n      command: [\"sleep\", \"5\"]\n",
+			mutation: "pre-stop",
+			wantOps:  []string{"add /spec/containers/0/lifecycle"},
+		},
+		{
+			name:     "preStop hook merged into the lifecycle",
+			config:   "preStop:\n  handler:\n    exec:\n      command: [\"sleep\", \"5\"]\n",
+			mutation: "pre-stop",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PostStart: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+			},
+			wantOps: []string{"add /spec/containers/0/lifecycle/preStop"},
+		},
+		{
+			name:     "existing preStop hook kept",
+			config:   "preStop:\n  handler:\n    exec:\n      command: [\"sleep\", \"5\"]\n",
+			mutation: "pre-stop",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+			},
+		},
+		{
+			name:     "existing preStop hook forced",
+			config:   "preStop:\n  handler:\n    exec:\n      command: [\"sleep\", \"5\"]\n",
+			mutation: "pre-stop",
+			force:    true,
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+			},
+			wantOps: []string{"replace /spec/containers/0/lifecycle/preStop"},
+		},
+		{
+			name:     "startup probe added to the targeted containers",
+			config:   "startupProbe:\n  containers: [\"app\"]\n  probe:\n    tcpSocket:\n      port: 8080\n",
+			mutation: "startup-probe",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = append([]corev1.Container{{Name: "worker", Image: "worker:1.0"}}, pod.Spec.Containers...)
+			},
+			wantOps: []string{"add /spec/containers/1/startupProbe"},
+		},
+		{
+			name:     "startup probe opted out",
+			config:   "startupProbe:\n  probe:\n    tcpSocket:\n      port: 8080\n",
+			mutation: "startup-probe",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationStartupKey: "off"}
+			},
+		},
+		{
+			name:     "configmap volume mounted",
+			config:   "configMapVolume:\n  name: app-config\n  configMapName: app-config\n  mountPath: /etc/app-config\n",
+			mutation: "configmap-volume",
+			wantOps:  []string{"add /spec/volumes", "add /spec/containers/0/volumeMounts"},
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if mount := pod.Spec.Containers[0].VolumeMounts[0]; mount.MountPath != "/etc/app-config" || !mount.ReadOnly {
+					t.Errorf("mount %+v, want read-only at /etc/app-config", mount)
+				}
+			},
+		},
+		{
+			name:     "configmap volume mount path from the annotation",
+			config:   "configMapVolume:\n  name: app-config\n  configMapName: app-config\n  mountPath: /etc/app-config\n",
+			mutation: "configmap-volume",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationMountKey: "/config/"}
+			},
+			wantOps: []string{"add /spec/volumes", "add /spec/containers/0/volumeMounts"},
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if mount := pod.Spec.Containers[0].VolumeMounts[0]; mount.MountPath != "/config" {
+					t.Errorf("mounted at %s, want /config", mount.MountPath)
+				}
+			},
+		},
+		{
+			name:     "relative mount path annotation ignored",
+			config:   "configMapVolume:\n  name: app-config\n  configMapName: app-config\n  mountPath: /etc/app-config\n",
+			mutation: "configmap-volume",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationMountKey: "config"}
+			},
+			wantOps:      []string{"add /spec/volumes", "add /spec/containers/0/volumeMounts"},
+			wantWarnings: 1,
+		},
+		{
+			name:     "service account token volume appended",
+			config:   "serviceAccountToken:\n  volumeName: vault-token\n  audience: vault\n  path: token\n  mountPath: /var/run/secrets/vault\n",
+			mutation: "service-account-token-volume",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Volumes = []corev1.Volume{{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+				pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "cache", MountPath: "/var/cache/app"}}
+			},
+			wantOps: []string{"add /spec/volumes/-", "add /spec/containers/0/volumeMounts/-"},
+		},
+		{
+			name:     "volumes mounted",
+			config:   "volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n  - name: certs\n    secret:\n      secretName: app-certs\n    mountPath: /etc/app-certs/tls.crt\n    subPath: tls.crt\n    readOnly: true\n",
+			mutation: "volumes",
+			wantOps: []string{
+				"add /spec/volumes", "add /spec/containers/0/volumeMounts",
+				"add /spec/volumes/-", "add /spec/containers/0/volumeMounts/-",
+			},
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if mount := pod.Spec.Containers[0].VolumeMounts[1]; mount.SubPath != "tls.crt" || !mount.ReadOnly {
+					t.Errorf("mount %+v, want the read-only subPath tls.crt", mount)
+				}
+			},
+		},
+		{
+			name:     "volume already mounted",
+			config:   "volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n",
+			mutation: "volumes",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Volumes = []corev1.Volume{{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+				pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "cache", MountPath: "/var/cache/app/"}}
+			},
+		},
+		{
+			name:     "conflicting mount skipped",
+			config:   "volumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n",
+			mutation: "volumes",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/var/cache/app"}}
+			},
+			wantOps:      []string{"add /spec/volumes"},
+			wantWarnings: 1,
+		},
+		{
+			name:     "conflicting mount added with a warning",
+			config:   "mountConflictPolicy: Warn\nvolumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n",
+			mutation: "volumes",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/var/cache/app"}}
+			},
+			wantOps:      []string{"add /spec/volumes", "add /spec/containers/0/volumeMounts/-"},
+			wantWarnings: 1,
+		},
+		{
+			name:     "volumes mounted into init containers",
+			config:   "mountInitContainers: true\nvolumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n",
+			mutation: "volumes",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox:1.32"}}
+			},
+			wantOps: []string{"add /spec/volumes", "add /spec/initContainers/0/volumeMounts", "add /spec/containers/0/volumeMounts"},
+		},
+		{
+			name:     "volumes mounted into the matching containers",
+			config:   "mountContainers: app\nexcludeContainers: [\"istio-proxy\"]\nvolumes:\n  - name: cache\n    emptyDir: {}\n    mountPath: /var/cache/app\n",
+			mutation: "volumes",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = append([]corev1.Container{{Name: "worker", Image: "worker:1.0"}}, pod.Spec.Containers...)
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.8.0"})
+			},
+			wantOps: []string{"add /spec/volumes", "add /spec/containers/1/volumeMounts"},
+		},
+		{
+			name:     "topology spread constraints added",
+			config:   "topologySpreadConstraints:\n  - maxSkew: 1\n    topologyKey: topology.kubernetes.io/zone\n    whenUnsatisfiable: ScheduleAnyway\n",
+			mutation: "topology-spread-constraints",
+			wantOps:  []string{"add /spec/topologySpreadConstraints"},
+		},
+		{
+			name:     "topology spread constraints appended",
+			config:   "topologySpreadConstraints:\n  - maxSkew: 1\n    topologyKey: topology.kubernetes.io/zone\n    whenUnsatisfiable: ScheduleAnyway\n",
+			mutation: "topology-spread-constraints",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{
+					{MaxSkew: 1, TopologyKey: corev1.LabelHostname, WhenUnsatisfiable: corev1.DoNotSchedule},
+				}
+			},
+			wantOps: []string{"add /spec/topologySpreadConstraints/-"},
+		},
+		{
+			name:     "existing topology spread constraint kept",
+			config:   "topologySpreadConstraints:\n  - maxSkew: 1\n    topologyKey: topology.kubernetes.io/zone\n    whenUnsatisfiable: ScheduleAnyway\n",
+			mutation: "topology-spread-constraints",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{
+					{MaxSkew: 2, TopologyKey: corev1.LabelZoneFailureDomainStable, WhenUnsatisfiable: corev1.ScheduleAnyway},
+				}
+			},
+		},
+		{
+			name:     "topology spread constraints opted out",
+			config:   "topologySpreadConstraints:\n  - maxSkew: 1\n    topologyKey: topology.kubernetes.io/zone\n    whenUnsatisfiable: ScheduleAnyway\n",
+			mutation: "topology-spread-constraints",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationTopologyKey: "no"}
+			},
+		},
+		{
+			name:     "envFrom sources added",
+			config:   "envFrom:\n  sources:\n    - configMapRef:\n        name: app-env\n",
+			mutation: "env-from",
+			wantOps:  []string{"add /spec/containers/0/envFrom"},
+		},
+		{
+			name:     "envFrom sources appended",
+			config:   "envFrom:\n  sources:\n    - configMapRef:\n        name: app-env\n",
+			mutation: "env-from",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}},
+				}
+			},
+			wantOps: []string{"add /spec/containers/0/envFrom/-"},
+		},
+		{
+			name:     "existing envFrom source kept",
+			config:   "envFrom:\n  sources:\n    - configMapRef:\n        name: app-env\n",
+			mutation: "env-from",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+					{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}},
+				}
+			},
+		},
+		{
+			name:     "resource defaults added",
+			config:   "resourceDefaults:\n  requests:\n    ephemeral-storage: 256Mi\n  limits:\n    ephemeral-storage: 1Gi\n",
+			mutation: "resource-defaults",
+			wantOps: []string{
+				"add /spec/containers/0/resources/requests", "add /spec/containers/0/resources/requests/ephemeral-storage",
+				"add /spec/containers/0/resources/limits", "add /spec/containers/0/resources/limits/ephemeral-storage",
+			},
+		},
+		{
+			name:     "default limit below the request skipped",
+			config:   "resourceDefaults:\n  requests:\n    ephemeral-storage: 256Mi\n  limits:\n    ephemeral-storage: 1Gi\n",
+			mutation: "resource-defaults",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("2Gi")}
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:     "resource defaults opted out",
+			config:   "resourceDefaults:\n  requests:\n    ephemeral-storage: 256Mi\n",
+			mutation: "resource-defaults",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationResourceKey: "false"}
+			},
+		},
+		{
+			name:     "GOMAXPROCS set to the CPU limit",
+			config:   "goMaxProcs:\n  enabled: true\n",
+			mutation: "gomaxprocs",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+			},
+			wantOps: []string{"add /spec/containers/0/env"},
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if env := pod.Spec.Containers[0].Env[0]; env.Value != "2" {
+					t.Errorf("GOMAXPROCS=%s, want 2", env.Value)
+				}
+			},
+		},
+		{
+			name:     "fractional CPU limit skipped",
+			config:   "goMaxProcs:\n  enabled: true\n",
+			mutation: "gomaxprocs",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m")}
+			},
+		},
+		{
+			name:     "existing GOMAXPROCS kept",
+			config:   "goMaxProcs:\n  enabled: true\n",
+			mutation: "gomaxprocs",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+				pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "GOMAXPROCS", Value: "1"}}
+			},
+		},
+		{
+			name:     "sidecar appended",
+			config:   "sidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\n",
+			mutation: "sidecars",
+			wantOps:  []string{"add /spec/containers/-"},
+			checkPatch: func(t *testing.T, patch []patchOperation) {
+				if policy, ok := patchedContainer(t, patch[0])["restartPolicy"]; ok {
+					t.Errorf("sidecar container has restartPolicy %v", policy)
+				}
+			},
+		},
+		{
+			name:     "running sidecar kept",
+			config:   "sidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\n",
+			mutation: "sidecars",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "log-shipper", Image: "fluent/fluent-bit:1.8"})
+			},
+		},
+		{
+			name:     "native sidecar added as init container",
+			config:   "nativeSidecars: true\nsidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\n",
+			mutation: "sidecars",
+			native:   true,
+			wantOps:  []string{"add /spec/initContainers"},
+			checkPatch: func(t *testing.T, patch []patchOperation) {
+				if policy := patchedContainer(t, patch[0])["restartPolicy"]; policy != "Always" {
+					t.Errorf("native sidecar restartPolicy %v, want Always", policy)
+				}
+			},
+		},
+		{
+			name:     "sidecar port used by the pod skipped",
+			config:   "sidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\n    ports:\n      - containerPort: 8080\n      - containerPort: 2020\n",
+			mutation: "sidecars",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 8080}}
+			},
+			wantOps:      []string{"add /spec/containers/-"},
+			wantWarnings: 1,
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if ports := pod.Spec.Containers[1].Ports; len(ports) != 1 || ports[0].ContainerPort != 2020 {
+					t.Errorf("sidecar ports %v, want only 2020", ports)
+				}
+			},
+		},
+		{
+			name:     "sidecar image selected by annotation",
+			config:   "sidecars:\n  - name: log-shipper\n    image: fluent/fluent-bit:1.9\nsidecarImages:\n  fluent-bit-2.0: fluent/fluent-bit:2.0\n",
+			mutation: "sidecars",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationImagesKey: "log-shipper=fluent-bit-2.0, proxy=envoy"}
+			},
+			wantOps:      []string{"add /spec/containers/-"},
+			wantWarnings: 1,
+			check: func(t *testing.T, pod *corev1.Pod) {
+				if image := pod.Spec.Containers[1].Image; image != "fluent/fluent-bit:2.0" {
+					t.Errorf("sidecar image %s, want fluent/fluent-bit:2.0", image)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, test.config))
+			whsvr.force = test.force
+			whsvr.nativeSidecars = test.native
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			if test.pod != nil {
+				test.pod(pod)
+			}
+
+			if test.disabled {
+				if mutationEnabled(t, whsvr, test.mutation) {
+					t.Errorf("mutation %s enabled", test.mutation)
+				}
+				return
+			}
+			ops, patch, m := runPodMutation(t, whsvr, test.mutation, pod)
+			if strings.Join(ops, ",") != strings.Join(test.wantOps, ",") {
+				t.Errorf("operations %q, want %q", ops, test.wantOps)
+			}
+			if len(m.warnings) != test.wantWarnings {
+				t.Errorf("warnings %v, want %d", m.warnings, test.wantWarnings)
+			}
+			if test.check != nil {
+				test.check(t, m.pod)
+			}
+			if test.checkPatch != nil && len(patch) > 0 {
+				test.checkPatch(t, patch)
+			}
+		})
+	}
+}
+
+func TestMutateSkips(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string                          // podLabels are configured in addition
+		pod          func(*corev1.Pod)               // changes to a pod running nginx:1.19 in the app container
+		request      func(*v1beta1.AdmissionRequest) // changes to the CREATE request of the pod
+		killSwitch   bool
+		podSelector  string
+		wantMutated  bool
+		wantWarnings int
+	}{
+		{
+			name:        "pod mutated",
+			wantMutated: true,
+		},
+		{
+			name:        "included namespace mutated",
+			config:      "includeNamespaces: [\"default\"]\n",
+			wantMutated: true,
+		},
+		{
+			name:   "namespace not included",
+			config: "includeNamespaces: [\"production\"]\n",
+		},
+		{
+			name:    "ignored namespace",
+			pod:     func(pod *corev1.Pod) { pod.Namespace = metav1.NamespaceSystem },
+			request: func(req *v1beta1.AdmissionRequest) { req.Namespace = metav1.NamespaceSystem },
+		},
+		{
+			name:    "operation not mutated",
+			request: func(req *v1beta1.AdmissionRequest) { req.Operation = v1beta1.Update },
+		},
+		{
+			name:        "configured operation mutated",
+			config:      "mutateOperations: [\"CREATE\", \"UPDATE\"]\n",
+			request:     func(req *v1beta1.AdmissionRequest) { req.Operation = v1beta1.Update },
+			wantMutated: true,
+		},
+		{
+			name:    "status subresource",
+			request: func(req *v1beta1.AdmissionRequest) { req.SubResource = "status" },
+		},
+		{
+			name: "opted out",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationMutateKey: "false"}
+			},
+		},
+		{
+			name: "already mutated",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}
+			},
+		},
+		{
+			name: "force reinjected",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "mutated", admissionWebhookAnnotationReinjectKey: "true"}
+			},
+			wantMutated: true,
+		},
+		{
+			name:   "already mutated on update",
+			config: "mutateOperations: [\"CREATE\", \"UPDATE\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}
+			},
+			request: func(req *v1beta1.AdmissionRequest) { req.Operation = v1beta1.Update },
+		},
+		{
+			name:   "force reinjected on update",
+			config: "mutateOperations: [\"CREATE\", \"UPDATE\"]\n",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "mutated", admissionWebhookAnnotationReinjectKey: "true"}
+			},
+			request:     func(req *v1beta1.AdmissionRequest) { req.Operation = v1beta1.Update },
+			wantMutated: true,
+		},
+		{
+			name:        "pod selector not matched",
+			podSelector: "inject=true",
+		},
+		{
+			name:        "pod selector matched",
+			podSelector: "inject=true",
+			pod:         func(pod *corev1.Pod) { pod.Labels = map[string]string{"inject": "true"} },
+			wantMutated: true,
+		},
+		{
+			name:       "kill switch on",
+			killSwitch: true,
+		},
+		{
+			name:         "terminating namespace",
+			config:       "skipTerminatingNamespaces: true\n",
+			pod:          func(pod *corev1.Pod) { pod.Namespace = "retired" },
+			request:      func(req *v1beta1.AdmissionRequest) { req.Namespace = "retired" },
+			wantWarnings: 1,
+		},
+	}
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "retired"}, Status: corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"+test.config))
+			whsvr.namespaceLister = corelisters.NewNamespaceLister(namespaces)
+			if test.killSwitch {
+				whsvr.killSwitch = &killSwitch{active: 1}
+			}
+			if test.podSelector != "" {
+				selector, err := labels.Parse(test.podSelector)
+				if err != nil {
+					t.Fatal(err)
+				}
+				whsvr.podSelector = selector
+			}
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			if test.pod != nil {
+				test.pod(pod)
+			}
+			review := admissionReview(t, "Pod", pod.Namespace, pod)
+			if test.request != nil {
+				test.request(review.Request)
+			}
+
+			resp := whsvr.mutate(context.Background(), review, "", true)
+			if !resp.Allowed {
+				t.Fatalf("pod denied: %v", resp.Result)
+			}
+			if mutated := resp.Patch != nil; mutated != test.wantMutated {
+				t.Errorf("mutated %v, want %v", mutated, test.wantMutated)
+			}
+			if len(resp.Warnings) != test.wantWarnings {
+				t.Errorf("warnings %v, want %d", resp.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestRequiredSecret(t *testing.T) {
+	tests := []struct {
+		name         string
+		action       string
+		secret       bool // the secret exists in the pod namespace
+		wantAllowed  bool
+		wantMutated  bool
+		wantWarnings int
+	}{
+		{name: "present secret mutated", action: ruleActionWarn, secret: true, wantAllowed: true, wantMutated: true},
+		{name: "missing secret warned", action: ruleActionWarn, wantAllowed: true, wantWarnings: 1},
+		{name: "present secret mutated under deny", action: ruleActionDeny, secret: true, wantAllowed: true, wantMutated: true},
+		{name: "missing secret denied", action: ruleActionDeny},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if test.secret {
+				objects = append(objects, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "app-certs", Namespace: "default"}})
+			}
+			client := fake.NewSimpleClientset(objects...)
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\nrequiredSecret:\n  name: app-certs\n  action: "+test.action+"\n"))
+			var err error
+			if whsvr.secretLister, err = newSecretLister(client, "app-certs", stopCh); err != nil {
+				t.Fatal(err)
+			}
+			whsvr.client = client
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+
+			resp := whsvr.mutate(context.Background(), admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+			if resp.Allowed != test.wantAllowed {
+				t.Fatalf("allowed %v, want %v", resp.Allowed, test.wantAllowed)
+			}
+			if mutated := resp.Patch != nil; mutated != test.wantMutated {
+				t.Errorf("mutated %v, want %v", mutated, test.wantMutated)
+			}
+			if len(resp.Warnings) != test.wantWarnings {
+				t.Errorf("warnings %v, want %d", resp.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	enabled := "auditAnnotations:\n  enabled: true\n  extra:\n    example.com/team: platform\n"
+	privileged := func(pod *corev1.Pod) {
+		privileged := true
+		pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	}
+	tests := []struct {
+		name        string
+		config      string // podLabels and privilegedContainers are configured in addition
+		path        string
+		pod         func(*corev1.Pod) // changes to a pod running nginx:1.19 in the app container, nil reviews a Service
+		wantAllowed bool
+		want        map[string]string
+	}{
+		{
+			name:        "mutated pod",
+			config:      enabled,
+			path:        "/mutate",
+			pod:         func(*corev1.Pod) {},
+			wantAllowed: true,
+			want:        map[string]string{"example.com/team": "platform", "mutated": "true"},
+		},
+		{
+			name:        "disabled",
+			config:      "auditAnnotations:\n  enabled: false\n",
+			path:        "/mutate",
+			pod:         func(*corev1.Pod) {},
+			wantAllowed: true,
+		},
+		{
+			name:        "allowed pod",
+			config:      enabled,
+			path:        "/validate",
+			pod:         func(*corev1.Pod) {},
+			wantAllowed: true,
+			want:        map[string]string{"example.com/team": "platform", "allowed": "true"},
+		},
+		{
+			name:   "denied pod",
+			config: enabled,
+			path:   "/validate",
+			pod:    privileged,
+			want:   map[string]string{"example.com/team": "platform", "allowed": "false", "rule": "privileged-containers"},
+		},
+		{
+			name:   "service missing the required labels",
+			config: enabled,
+			path:   "/validate",
+			want:   map[string]string{"example.com/team": "platform", "allowed": "false", "rule": "required-labels"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\nprivilegedContainers:\n  enabled: true\n"+test.config))
+			var review *v1beta1.AdmissionReview
+			if test.pod != nil {
+				pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+				test.pod(pod)
+				review = admissionReview(t, "Pod", pod.Namespace, pod)
+			} else {
+				service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+				review = admissionReview(t, "Service", service.Namespace, service)
+			}
+
+			var resp *v1beta1.AdmissionResponse
+			if test.path == "/mutate" {
+				resp = whsvr.mutate(context.Background(), review, "", true)
+			} else {
+				resp = whsvr.validate(review, true)
+			}
+			if resp.Allowed != test.wantAllowed {
+				t.Errorf("allowed %v, want %v", resp.Allowed, test.wantAllowed)
+			}
+			if !reflect.DeepEqual(resp.AuditAnnotations, test.want) {
+				t.Errorf("audit annotations %v, want %v", resp.AuditAnnotations, test.want)
+			}
+		})
+	}
+}
+
+func TestLogSampled(t *testing.T) {
+	tests := []struct {
+		rate        int
+		wantSampled int // of 100 requests
+	}{
+		{rate: 0, wantSampled: 100},
+		{rate: 1, wantSampled: 100},
+		{rate: 10, wantSampled: 10},
+		{rate: 30, wantSampled: 4},
+	}
+	for _, test := range tests {
+		whsvr := &WebhookServer{logSampleRate: test.rate}
+		sampled := 0
+		for i := 0; i < 100; i++ {
+			if whsvr.logSampled() {
+				sampled++
+			} else if i == 0 {
+				t.Errorf("rate %d: first request not logged", test.rate)
+			}
+		}
+		if sampled != test.wantSampled {
+			t.Errorf("rate %d: %d of 100 requests logged, want %d", test.rate, sampled, test.wantSampled)
+		}
+	}
+}
+
+func TestServeConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "disabled", authorization: "Bearer admin-secret", wantStatus: http.StatusNotFound},
+		{name: "no token", adminToken: "admin-secret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "admin-secret", authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "admin token", adminToken: "admin-secret", authorization: "Bearer admin-secret", wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "maxContainers: 5\n"))
+			whsvr.adminToken = test.adminToken
+			whsvr.parameters = WhSvrParameters{adminTokenFile: "/etc/webhook/admin/token", patchWorkers: 4}
+			r := httptest.NewRequest(http.MethodGet, "/config", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			whsvr.serveConfig(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, test.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if strings.Contains(w.Body.String(), "admin-secret") {
+				t.Error("configuration exposes the admin token")
+			}
+			var got struct {
+				Config             Config `json:"config"`
+				AdminTokenFile     string `json:"adminTokenFile"`
+				PatchWorkers       int    `json:"patchWorkers"`
+				AnnotationPrefix   string `json:"annotationPrefix"`
+				APIServerTokenFile string `json:"apiServerTokenFile"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid configuration %s: %v", w.Body, err)
+			}
+			if got.Config.MaxContainers != 5 || got.AdminTokenFile != "/etc/webhook/admin/token" || got.PatchWorkers != 4 ||
+				got.AnnotationPrefix != defaultAnnotationPrefix {
+				t.Errorf("configuration %s lacks the server settings", w.Body)
+			}
+		})
+	}
+}
+
+func TestAnnotationPrefix(t *testing.T) {
+	setAnnotationPrefix("webhook.example.com")
+	t.Cleanup(func() { setAnnotationPrefix(defaultAnnotationPrefix) })
+	privileged := func(pod *corev1.Pod) {
+		privileged := true
+		pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	}
+	tests := []struct {
+		name        string
+		path        string
+		annotations map[string]string
+		pod         func(*corev1.Pod) // changes to a pod running nginx:1.19 in the app container
+		wantAllowed bool
+		wantMutated bool
+	}{
+		{
+			name:        "mutate opt-out",
+			path:        "/mutate",
+			annotations: map[string]string{"webhook.example.com/mutate": "false"},
+			wantAllowed: true,
+		},
+		{
+			name:        "default mutate opt-out ignored",
+			path:        "/mutate",
+			annotations: map[string]string{defaultAnnotationPrefix + "/mutate": "false"},
+			wantAllowed: true,
+			wantMutated: true,
+		},
+		{
+			name:        "already mutated",
+			path:        "/mutate",
+			annotations: map[string]string{"webhook.example.com/status": "mutated"},
+			wantAllowed: true,
+		},
+		{
+			name:        "default status ignored",
+			path:        "/mutate",
+			annotations: map[string]string{defaultAnnotationPrefix + "/status": "mutated"},
+			wantAllowed: true,
+			wantMutated: true,
+		},
+		{
+			name:        "validate opt-out",
+			path:        "/validate",
+			annotations: map[string]string{"webhook.example.com/validate": "false"},
+			pod:         privileged,
+			wantAllowed: true,
+		},
+		{
+			name:        "default validate opt-out ignored",
+			path:        "/validate",
+			annotations: map[string]string{defaultAnnotationPrefix + "/validate": "false"},
+			pod:         privileged,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\nprivilegedContainers:\n  enabled: true\n"))
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+			pod.Annotations = test.annotations
+			if test.pod != nil {
+				test.pod(pod)
+			}
+			review := admissionReview(t, "Pod", pod.Namespace, pod)
+
+			var resp *v1beta1.AdmissionResponse
+			if test.path == "/mutate" {
+				resp = whsvr.mutate(context.Background(), review, "", true)
+			} else {
+				resp = whsvr.validate(review, true)
+			}
+			if resp.Allowed != test.wantAllowed {
+				t.Fatalf("allowed %v, want %v", resp.Allowed, test.wantAllowed)
+			}
+			if mutated := resp.Patch != nil; mutated != test.wantMutated {
+				t.Fatalf("mutated %v, want %v", mutated, test.wantMutated)
+			}
+			if !test.wantMutated {
+				return
+			}
+			// the status annotation is written under the custom prefix
+			var status interface{}
+			for _, op := range decodePatch(t, resp.Patch) {
+				if op.Path == "/metadata/annotations" {
+					status = op.Value.(map[string]interface{})["webhook.example.com/status"]
+				} else if op.Path == "/metadata/annotations/webhook.example.com~1status" {
+					status = op.Value
+				}
+			}
+			if status != "mutated" {
+				t.Errorf("patch %s does not set the custom status annotation", resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutateGenericPatches(t *testing.T) {
+	config := "genericPatches:\n  - kinds: [\"ConfigMap\"]\n    patch:\n      - {op: add, path: /data/region, value: eu-west-1}\n"
+	tests := []struct {
+		name      string
+		config    string
+		wantPatch bool
+	}{
+		{
+			name:      "configured kind",
+			config:    config,
+			wantPatch: true,
+		},
+		{
+			name: "no generic patches",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, test.config))
+			configMap := &corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Data:       map[string]string{"key": "value"},
+			}
+
+			resp := whsvr.mutate(context.Background(), admissionReview(t, "ConfigMap", configMap.Namespace, configMap), "", true)
+			if !resp.Allowed {
+				t.Fatalf("config map denied: %v", resp.Result)
+			}
+			if !test.wantPatch {
+				if resp.Patch != nil {
+					t.Errorf("patch %s, want none", resp.Patch)
+				}
+				return
+			}
+			// the generic operations follow the status annotations
+			ops := decodePatch(t, resp.Patch)
+			last := ops[len(ops)-1]
+			if last.Op != "add" || last.Path != "/data/region" || last.Value != "eu-west-1" {
+				t.Errorf("patch %s does not end with the configured operation", resp.Patch)
+			}
+			if ops[0].Path != "/metadata/annotations" {
+				t.Errorf("patch %s does not record the status annotations", resp.Patch)
+			}
+		})
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration // of the request context, none when 0
+		wantAllowed bool
+		wantMin     time.Duration
+		wantMax     time.Duration
+	}{
+		{name: "delayed", wantAllowed: true, wantMin: 200 * time.Millisecond, wantMax: time.Second},
+		{name: "cancelled", timeout: 20 * time.Millisecond, wantMax: 150 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			whsvr := newTestServer(t, testConfig(t, "podLabels:\n  team: platform\n"))
+			whsvr.responseDelay = 200 * time.Millisecond
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			pod := testPod(corev1.Container{Name: "app", Image: "nginx:1.19"})
+
+			start := time.Now()
+			resp := whsvr.mutate(ctx, admissionReview(t, "Pod", pod.Namespace, pod), "", true)
+			elapsed := time.Since(start)
+			if elapsed < test.wantMin || elapsed > test.wantMax {
+				t.Errorf("responded after %v, want between %v and %v", elapsed, test.wantMin, test.wantMax)
+			}
+			if resp.Allowed != test.wantAllowed {
+				t.Fatalf("allowed %v, want %v", resp.Allowed, test.wantAllowed)
+			}
+			if !resp.Allowed && resp.Result.Code != http.StatusInternalServerError {
+				t.Errorf("code %d, want 500", resp.Result.Code)
+			}
+		})
+	}
+}
+
+func TestCanarySelected(t *testing.T) {
+	const requests = 10000
+	selected := 0
+	for i := 0; i < requests; i++ {
+		uid := types.UID(fmt.Sprintf("request-%d", i))
+		if canarySelected(uid, 25) {
+			selected++
+			// a retried request stays inside the canary
+			if !canarySelected(uid, 25) {
+				t.Fatalf("request %s selected once only", uid)
+			}
+		}
+	}
+	if selected < 2300 || selected > 2700 {
+		t.Errorf("%d of %d requests selected at 25%%, want about %d", selected, requests, requests/4)
+	}
+	for _, percent := range []int{0, 100} {
+		if got := canarySelected("request-0", percent); got != (percent == 100) {
+			t.Errorf("selected %v at %d%%", got, percent)
+		}
+	}
+}
+
+func TestServeReadyz(t *testing.T) {
+	whsvr := newTestServer(t, testConfig(t, ""))
+	probe := func(want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		whsvr.serveReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != want {
+			t.Errorf("status %d, want %d", w.Code, want)
+		}
+	}
+
+	probe(http.StatusServiceUnavailable)
+	whsvr.setReady(true)
+	probe(http.StatusOK)
+	// shutdown begins
+	whsvr.setReady(false)
+	probe(http.StatusServiceUnavailable)
+}
+
+func TestServeHealthz(t *testing.T) {
+	data := "podLabels:\n  team: platform\npriorityClassName: high\n"
+	whsvr := newTestServer(t, testConfig(t, data))
+	whsvr.certNotAfter = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	whsvr.serveHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	var status healthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %s: %v", w.Body, err)
+	}
+	if want := []string{"pod-labels", "priority-class-name"}; !reflect.DeepEqual(status.Mutations, want) {
+		t.Errorf("mutations %v, want %v", status.Mutations, want)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte(data))); status.ConfigChecksum != want {
+		t.Errorf("config checksum %s, want %s", status.ConfigChecksum, want)
+	}
+	if !status.CertificateExpiry.Equal(whsvr.certNotAfter) {
+		t.Errorf("certificate expiry %v, want %v", status.CertificateExpiry, whsvr.certNotAfter)
+	}
+}
+
+func TestFieldManager(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation v1beta1.Operation
+		options   string
+		want      string
+	}{
+		{name: "no options", operation: v1beta1.Create},
+		{name: "create options", operation: v1beta1.Create, options: `{"kind":"CreateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"kubectl-client-side-apply"}`, want: "kubectl-client-side-apply"},
+		{name: "update options", operation: v1beta1.Update, options: `{"kind":"UpdateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"helm"}`, want: "helm"},
+		{name: "delete options", operation: v1beta1.Delete, options: `{"kind":"DeleteOptions","apiVersion":"meta.k8s.io/v1","dryRun":["All"]}`},
+		{name: "malformed options", operation: v1beta1.Create, options: `{"fieldManager":5}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &v1beta1.AdmissionRequest{UID: "test", Operation: test.operation}
+			if test.options != "" {
+				req.Options = runtime.RawExtension{Raw: []byte(test.options)}
+			}
+			if got := fieldManager(req); got != test.want {
+				t.Errorf("field manager %q, want %q", got, test.want)
+			}
+		})
+	}
+}